@@ -0,0 +1,344 @@
+package redis
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultCacheNegativeTTL = 5 * time.Second
+	defaultCacheBeta        = 1.0
+	defaultCacheLoadTimeout = 30 * time.Second
+)
+
+// CacheLoader load value from data source on cache miss,
+// return `ErrCacheNotFound` if data not exists.
+type CacheLoader func(ctx context.Context) (val string, err error)
+
+// Cache read-through cache
+//
+// Redis keys:
+//
+//	`<key>`: hash of {v: value, d: load duration in ms, n: "1" if negative}
+//
+// Implementations:
+//
+//  1. read value, load duration and remaining ttl by `HMGET` & `PTTL`
+//  2. on hit, refresh in background by probabilistic early expiration (XFetch),
+//     if `load_duration * beta * -ln(rand()) >= remaining_ttl`
+//  3. on miss, load value, concurrent loads of the same key are deduplicated
+//     by singleflight in process, and by `Mutex` across processes.
+//     after acquired mutex, read cache again in case of others already loaded it.
+//     background refreshing is deduplicated separately, so a miss never shares
+//     the result of a refreshing, but waits for its mutex then reads its value.
+//  4. if loader returns `ErrCacheNotFound`, cache negative result for negative ttl
+type Cache interface {
+	// GetOrLoad get value from cache, or load by loader and cache it with ttl
+	//
+	// return `ErrCacheNotFound` if data not exists.
+	// ttl 0 means default ttl set by `WithUtilsCacheTTL`, or never expire if not set.
+	GetOrLoad(ctx context.Context, key string, loader CacheLoader, ttl time.Duration) (string, error)
+	// Delete delete cached value
+	Delete(ctx context.Context, key string) error
+}
+
+type cacheOption struct {
+	negativeTTL time.Duration
+	beta        float64
+	loadTimeout time.Duration
+}
+
+type cache struct {
+	cacheOption
+	rdb    *Utils
+	logger gutils.LoggerItf
+	// sf deduplicate loads on miss
+	sf singleflight.Group
+	// refreshSF deduplicate background refreshing
+	refreshSF singleflight.Group
+}
+
+// CacheOptionFunc options for cache
+type CacheOptionFunc func(*cache) error
+
+// WithCacheNegativeTTL set ttl of negative result, 0 means do not cache negative result
+func WithCacheNegativeTTL(ttl time.Duration) CacheOptionFunc {
+	return func(c *cache) error {
+		if ttl < 0 {
+			return errors.Errorf("negative ttl must not less than 0")
+		}
+
+		c.negativeTTL = ttl
+		return nil
+	}
+}
+
+// WithCacheBeta set beta of XFetch, larger beta means refresh earlier,
+// 0 means disable early refresh
+func WithCacheBeta(beta float64) CacheOptionFunc {
+	return func(c *cache) error {
+		if beta < 0 {
+			return errors.Errorf("beta must not less than 0")
+		}
+
+		c.beta = beta
+		return nil
+	}
+}
+
+// WithCacheLoadTimeout set timeout of each load
+func WithCacheLoadTimeout(timeout time.Duration) CacheOptionFunc {
+	return func(c *cache) error {
+		if timeout <= 0 {
+			return errors.Errorf("timeout must greater than 0")
+		}
+
+		c.loadTimeout = timeout
+		return nil
+	}
+}
+
+// WithCacheLogger set cache's logger
+func WithCacheLogger(logger *gutils.LoggerType) CacheOptionFunc {
+	return func(c *cache) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// NewCache new read-through cache
+func (u *Utils) NewCache(opts ...CacheOptionFunc) (Cache, error) {
+	c := &cache{
+		rdb:    u,
+		logger: u.logger,
+		cacheOption: cacheOption{
+			negativeTTL: defaultCacheNegativeTTL,
+			beta:        defaultCacheBeta,
+			loadTimeout: defaultCacheLoadTimeout,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+type cacheEntry struct {
+	val       string
+	negative  bool
+	delta     time.Duration
+	remaining time.Duration
+}
+
+// get read cache entry, return redis.Nil if not exists
+func (c *cache) get(ctx context.Context, key string) (*cacheEntry, error) {
+	var (
+		fields *redis.SliceCmd
+		pttl   *redis.DurationCmd
+	)
+	if _, err := c.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		fields = p.HMGet(ctx, key, "v", "d", "n")
+		pttl = p.PTTL(ctx, key)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "get cache `%s`", key)
+	}
+
+	vals := fields.Val()
+	val, ok := vals[0].(string)
+	if !ok {
+		return nil, redis.Nil
+	}
+
+	e := &cacheEntry{
+		val:       val,
+		negative:  vals[2] == "1",
+		remaining: pttl.Val(),
+	}
+	if d, ok := vals[1].(string); ok {
+		ms, _ := strconv.ParseInt(d, 10, 64)
+		e.delta = time.Duration(ms) * time.Millisecond
+	}
+
+	return e, nil
+}
+
+// set write cache entry
+func (c *cache) set(ctx context.Context, key string, e *cacheEntry, ttl time.Duration) error {
+	if _, err := c.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, key)
+		p.HSet(ctx, key,
+			"v", e.val,
+			"d", e.delta.Milliseconds(),
+			"n", luaBool(e.negative))
+		if ttl > 0 {
+			p.PExpire(ctx, key, ttl)
+		}
+
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "set cache `%s`", key)
+	}
+
+	return nil
+}
+
+// shouldRefresh XFetch, refresh before expired with probability
+// increasing as expiration approaches
+func (c *cache) shouldRefresh(e *cacheEntry) bool {
+	if c.beta == 0 || e.negative || e.remaining <= 0 {
+		return false
+	}
+
+	gap := float64(e.delta) * c.beta * -math.Log(1-rand.Float64())
+	return time.Duration(gap) >= e.remaining
+}
+
+// result convert cache entry to return value
+func (e *cacheEntry) result() (string, error) {
+	if e.negative {
+		return "", ErrCacheNotFound
+	}
+
+	return e.val, nil
+}
+
+// GetOrLoad get value from cache, or load by loader and cache it with ttl
+//
+// ttl 0 means default ttl set by `WithUtilsCacheTTL`, or never expire if not set.
+func (c *cache) GetOrLoad(ctx context.Context, key string,
+	loader CacheLoader, ttl time.Duration) (string, error) {
+	if ttl == 0 {
+		ttl = c.rdb.cacheTTL
+	}
+
+	start := time.Now()
+	e, err := c.get(ctx, key)
+	if err != nil && !IsNil(err) {
+		c.rdb.observe(ctx, "cache", key, "get", start, false, err)
+		return "", err
+	}
+
+	c.rdb.observe(ctx, "cache", key, "get", start, e != nil, nil)
+
+	if e != nil {
+		if c.shouldRefresh(e) {
+			c.logger.Debug("refresh cache early",
+				zap.String("key", key), zap.Duration("remaining", e.remaining))
+			go c.refresh(key, loader, ttl)
+		}
+
+		return e.result()
+	}
+
+	// shared by all waiters, should not be canceled by any of them
+	ch := c.sf.DoChan(key, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.Background(), c.loadTimeout)
+		defer cancel()
+		return c.load(loadCtx, key, loader, ttl, true)
+	})
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case ret := <-ch:
+		if ret.Err != nil {
+			return "", ret.Err
+		}
+
+		return ret.Val.(*cacheEntry).result()
+	}
+}
+
+// refresh reload cache in background,
+// skip if others are loading the same key
+func (c *cache) refresh(key string, loader CacheLoader, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.loadTimeout)
+	defer cancel()
+
+	_, err, _ := c.refreshSF.Do(key, func() (interface{}, error) {
+		return c.load(ctx, key, loader, ttl, false)
+	})
+	if errors.Is(err, ErrLockTaken) {
+		c.logger.Debug("skip refreshing cache", zap.String("key", key), zap.Error(err))
+	} else if err != nil {
+		c.logger.Warn("refresh cache", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// load acquire mutex of key, then load value by loader and save it
+//
+// if blocking, wait for others to load, and reuse their result.
+// otherwise, return current value if others are loading.
+func (c *cache) load(ctx context.Context, key string,
+	loader CacheLoader, ttl time.Duration, blocking bool) (e *cacheEntry, err error) {
+	mu, err := c.rdb.NewMutex(key, WithMutexBlockingLock(blocking))
+	if err != nil {
+		return nil, err
+	}
+
+	_, lockCtx, err := mu.Lock(ctx)
+	if errors.Is(err, ErrLockTaken) {
+		return nil, errors.Wrapf(err, "cache `%s` is loading by others", key)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "lock cache `%s`", key)
+	}
+	defer func() {
+		if err := mu.Unlock(context.Background()); err != nil {
+			c.logger.Warn("unlock cache", zap.String("key", key), zap.Error(err))
+		}
+	}()
+
+	// others may already loaded the value while waiting for the lock
+	if blocking {
+		if e, err = c.get(ctx, key); err == nil {
+			return e, nil
+		} else if !IsNil(err) {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	e = &cacheEntry{}
+	e.val, err = loader(lockCtx)
+	c.rdb.observe(ctx, "cache", key, "load", start, err == nil, err)
+	if err != nil {
+		if !errors.Is(err, ErrCacheNotFound) {
+			return nil, errors.Wrapf(err, "load cache `%s`", key)
+		}
+
+		e.negative = true
+		if c.negativeTTL == 0 {
+			return e, nil
+		}
+
+		ttl = c.negativeTTL
+	}
+
+	e.delta = time.Since(start)
+	if err = c.set(ctx, key, e, ttl); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Delete delete cached value
+func (c *cache) Delete(ctx context.Context, key string) error {
+	if err := c.rdb.Del(ctx, key).Err(); err != nil {
+		return errors.Wrapf(err, "delete cache `%s`", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewCache(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := rtils.NewCache(WithCacheNegativeTTL(time.Second))
+	require.NoError(t, err)
+
+	// concurrent loads are deduplicated
+	key := "/TestUtils_NewCache/" + gutils.RandomStringWithLength(10)
+	var loaded int32
+	loader := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&loaded, 1)
+		time.Sleep(100 * time.Millisecond)
+		return "val", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := c.GetOrLoad(ctx, key, loader, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, "val", val)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&loaded))
+
+	// negative result
+	negKey := key + "/neg"
+	notFound := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&loaded, 1)
+		return "", ErrCacheNotFound
+	}
+	_, err = c.GetOrLoad(ctx, negKey, notFound, time.Minute)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	_, err = c.GetOrLoad(ctx, negKey, notFound, time.Minute)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	require.Equal(t, int32(2), atomic.LoadInt32(&loaded))
+
+	// loader error is not cached
+	errKey := key + "/err"
+	_, err = c.GetOrLoad(ctx, errKey, func(ctx context.Context) (string, error) {
+		return "", errors.New("failed")
+	}, time.Minute)
+	require.Error(t, err)
+	val, err := c.GetOrLoad(ctx, errKey, loader, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "val", val)
+
+	require.NoError(t, c.Delete(ctx, errKey))
+	_, err = rdb.Get(ctx, errKey).Result()
+	require.True(t, IsNil(err))
+}
+
+func TestCache_shouldRefresh(t *testing.T) {
+	c := &cache{cacheOption: cacheOption{beta: defaultCacheBeta}}
+
+	require.False(t, c.shouldRefresh(&cacheEntry{delta: time.Millisecond, remaining: time.Hour}))
+	require.True(t, c.shouldRefresh(&cacheEntry{delta: time.Hour, remaining: time.Nanosecond}))
+	require.False(t, c.shouldRefresh(&cacheEntry{delta: time.Hour, remaining: time.Nanosecond, negative: true}))
+}
+
+func TestCache_missDuringRefresh(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := rtils.NewCache()
+	require.NoError(t, err)
+
+	key := "/TestCache_missDuringRefresh/" + gutils.RandomStringWithLength(10)
+	entered, release := make(chan struct{}), make(chan struct{})
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		c.(*cache).refresh(key, func(ctx context.Context) (string, error) {
+			close(entered)
+			<-release
+			return "", errors.New("refresh failed")
+		}, time.Minute)
+	}()
+	<-entered
+
+	// miss should not share the failed result of refreshing
+	got := make(chan error, 1)
+	go func() {
+		val, err := c.GetOrLoad(ctx, key, func(ctx context.Context) (string, error) {
+			return "val", nil
+		}, time.Minute)
+		if err == nil && val != "val" {
+			err = errors.Errorf("got `%s`", val)
+		}
+
+		got <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-got)
+	<-refreshed
+}
@@ -0,0 +1,186 @@
+package redis
+
+import (
+	"context"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCappedListMaxLen = 100
+)
+
+// CappedListEvictFunc callback of evicted items
+type CappedListEvictFunc func(ctx context.Context, key string, items []string)
+
+// CappedList list with max length
+//
+// Implementations:
+//
+// push items and trim list in one `MULTI` transaction:
+//
+//   - keep newest: `RPUSH` items, then `LTRIM key -max -1`,
+//     the oldest items at head are evicted
+//   - keep oldest: `RPUSH` items, then `LTRIM key 0 max-1`,
+//     the new items exceed max length are evicted
+//
+// evicted items are read by `LRANGE` in the same transaction
+// only if eviction callback or spill-over key is set.
+type CappedList interface {
+	// Push push items to the tail of list, return how many items are evicted
+	Push(ctx context.Context, payloads ...interface{}) (evicted int64, err error)
+}
+
+type cappedListOption struct {
+	maxLen     int64
+	keepOldest bool
+	onEvict    CappedListEvictFunc
+	spillKey   string
+}
+
+type cappedList struct {
+	cappedListOption
+	rdb    *Utils
+	logger gutils.LoggerItf
+	key    string
+}
+
+// CappedListOptionFunc options for capped list
+type CappedListOptionFunc func(*cappedList) error
+
+// WithCappedListMaxLen set max length of list
+func WithCappedListMaxLen(maxLen int64) CappedListOptionFunc {
+	return func(l *cappedList) error {
+		if maxLen <= 0 {
+			return errors.Errorf("max length must greater than 0")
+		}
+
+		l.maxLen = maxLen
+		return nil
+	}
+}
+
+// WithCappedListKeepOldest set whether to keep the oldest items,
+// if true, new items will be evicted once list is full.
+//
+// default to keep the newest items.
+func WithCappedListKeepOldest(keepOldest bool) CappedListOptionFunc {
+	return func(l *cappedList) error {
+		l.keepOldest = keepOldest
+		return nil
+	}
+}
+
+// WithCappedListOnEvict set callback of evicted items
+func WithCappedListOnEvict(onEvict CappedListEvictFunc) CappedListOptionFunc {
+	return func(l *cappedList) error {
+		l.onEvict = onEvict
+		return nil
+	}
+}
+
+// WithCappedListSpillKey rpush evicted items to another list.
+//
+// spill is not in the same transaction of push,
+// in cluster mode, spill key could be in any slot.
+func WithCappedListSpillKey(key string) CappedListOptionFunc {
+	return func(l *cappedList) error {
+		l.spillKey = key
+		return nil
+	}
+}
+
+// WithCappedListLogger set capped list's logger
+func WithCappedListLogger(logger *gutils.LoggerType) CappedListOptionFunc {
+	return func(l *cappedList) error {
+		l.logger = logger
+		return nil
+	}
+}
+
+// NewCappedList new list with max length
+func (u *Utils) NewCappedList(key string, opts ...CappedListOptionFunc) (CappedList, error) {
+	if key == "" {
+		return nil, errors.Errorf("key must not be empty")
+	}
+
+	l := &cappedList{
+		rdb:    u,
+		logger: u.logger,
+		key:    key,
+		cappedListOption: cappedListOption{
+			maxLen: defaultCappedListMaxLen,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(l); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Push push items to the tail of list, return how many items are evicted
+func (l *cappedList) Push(ctx context.Context, payloads ...interface{}) (evicted int64, err error) {
+	if len(payloads) == 0 {
+		return 0, nil
+	}
+
+	var (
+		length     *redis.IntCmd
+		evictedCmd *redis.StringSliceCmd
+		collect    = l.onEvict != nil || l.spillKey != ""
+	)
+	if _, err = l.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		length = p.RPush(ctx, l.key, payloads...)
+		if l.keepOldest {
+			if collect {
+				evictedCmd = p.LRange(ctx, l.key, l.maxLen, -1)
+			}
+
+			p.LTrim(ctx, l.key, 0, l.maxLen-1)
+		} else {
+			if collect {
+				evictedCmd = p.LRange(ctx, l.key, 0, -l.maxLen-1)
+			}
+
+			p.LTrim(ctx, l.key, -l.maxLen, -1)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, errors.Wrapf(err, "push to capped list `%s`", l.key)
+	}
+
+	if evicted = length.Val() - l.maxLen; evicted <= 0 {
+		return 0, nil
+	}
+
+	l.logger.Debug("evict items from capped list",
+		zap.String("key", l.key), zap.Int64("evicted", evicted))
+	if !collect {
+		return evicted, nil
+	}
+
+	items := evictedCmd.Val()
+	if l.spillKey != "" {
+		spill := make([]interface{}, len(items))
+		for i, item := range items {
+			spill[i] = item
+		}
+
+		if err = l.rdb.UniversalClient.RPush(ctx, l.spillKey, spill...).Err(); err != nil {
+			return evicted, errors.Wrapf(err, "spill evicted items to `%s`", l.spillKey)
+		}
+	}
+
+	if l.onEvict != nil {
+		l.onEvict(ctx, l.key, items)
+	}
+
+	return evicted, nil
+}
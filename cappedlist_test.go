@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewCappedList(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("keep newest", func(t *testing.T) {
+		key := gutils.RandomStringWithLength(20)
+		spill := key + "/spill"
+		var evictedItems []string
+		l, err := rtils.NewCappedList(key,
+			WithCappedListMaxLen(3),
+			WithCappedListSpillKey(spill),
+			WithCappedListOnEvict(func(ctx context.Context, key string, items []string) {
+				evictedItems = append(evictedItems, items...)
+			}),
+		)
+		require.NoError(t, err)
+
+		evicted, err := l.Push(ctx, "1", "2")
+		require.NoError(t, err)
+		require.Zero(t, evicted)
+
+		evicted, err = l.Push(ctx, "3", "4", "5")
+		require.NoError(t, err)
+		require.Equal(t, int64(2), evicted)
+		require.Equal(t, []string{"1", "2"}, evictedItems)
+
+		items, err := rdb.LRange(ctx, key, 0, -1).Result()
+		require.NoError(t, err)
+		require.Equal(t, []string{"3", "4", "5"}, items)
+
+		items, err = rdb.LRange(ctx, spill, 0, -1).Result()
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "2"}, items)
+	})
+
+	t.Run("keep oldest", func(t *testing.T) {
+		key := gutils.RandomStringWithLength(20)
+		l, err := rtils.NewCappedList(key,
+			WithCappedListMaxLen(3),
+			WithCappedListKeepOldest(true),
+		)
+		require.NoError(t, err)
+
+		evicted, err := l.Push(ctx, "1", "2", "3", "4")
+		require.NoError(t, err)
+		require.Equal(t, int64(1), evicted)
+
+		items, err := rdb.LRange(ctx, key, 0, -1).Result()
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "2", "3"}, items)
+	})
+
+	t.Run("rpush", func(t *testing.T) {
+		key := gutils.RandomStringWithLength(20)
+		for i := 0; i < 150; i++ {
+			require.NoError(t, rtils.RPush(ctx, key, i))
+		}
+
+		n, err := rdb.LLen(ctx, key).Result()
+		require.NoError(t, err)
+		require.Equal(t, int64(100), n)
+	})
+
+	_, err := rtils.NewCappedList("key", WithCappedListMaxLen(0))
+	require.Error(t, err)
+}
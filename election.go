@@ -0,0 +1,416 @@
+package redis
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultElectionObserveInterval = time.Second
+	electionCleanupTimeout         = 5 * time.Second
+)
+
+// electionPromoteScript save leader's metadata if lock is held by leader
+//
+// KEYS[1]: lock key, hash of owner & count
+// KEYS[2]: leader's metadata, hash of owner, id, address & since
+// ARGV[1]: client id of lock
+// ARGV[2]: candidate id
+// ARGV[3]: address
+// ARGV[4]: since, unix milliseconds
+// ARGV[5]: leader changed channel
+//
+// return 1 if saved, 0 if lock is not held by this client
+var electionPromoteScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "owner") ~= ARGV[1] then
+	return 0
+end
+
+redis.call("DEL", KEYS[2])
+redis.call("HSET", KEYS[2], "owner", ARGV[1], "id", ARGV[2], "address", ARGV[3], "since", ARGV[4])
+redis.call("PUBLISH", ARGV[5], ARGV[2])
+return 1
+`)
+
+// electionLeaderScript load leader's metadata
+//
+// KEYS[1]: lock key, hash of owner & count
+// KEYS[2]: leader's metadata
+//
+// return {id, address, since}, or nil if lock is not held by the leader in metadata
+var electionLeaderScript = redis.NewScript(`
+local owner = redis.call("HGET", KEYS[1], "owner")
+if not owner or redis.call("HGET", KEYS[2], "owner") ~= owner then
+	return nil
+end
+return redis.call("HMGET", KEYS[2], "id", "address", "since")
+`)
+
+// electionCleanupScript delete leader's metadata if it belongs to this client
+//
+// KEYS[1]: leader's metadata
+// ARGV[1]: client id of lock
+// ARGV[2]: leader changed channel
+//
+// return 1 if deleted
+var electionCleanupScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "owner") ~= ARGV[1] then
+	return 0
+end
+
+redis.call("DEL", KEYS[1])
+redis.call("PUBLISH", ARGV[2], "")
+return 1
+`)
+
+// LeaderInfo metadata of leader
+type LeaderInfo struct {
+	// ID candidate id of leader
+	ID string
+	// Address address of leader, set by `WithElectionAddress`
+	Address string
+	// Since when leader is elected
+	Since time.Time
+}
+
+// Election leader election built on Mutex
+//
+// Redis keys:
+//
+//	`/rtils/sync/mutex/{<election_name>}`: lock of leader, same as `NewMutex(<election_name>)`
+//	`/rtils/sync/mutex/{<election_name>}/leader`: hash of leader's metadata
+//	`/rtils/sync/mutex/{<election_name>}/leader/changed`: pub/sub channel of leader changes
+//
+// Implementations:
+//
+//  1. campaign: acquire the lock by `Mutex.Acquire`,
+//     then save metadata and publish to changed channel if lock is still held
+//  2. leadership ends once lock's context is done, e.g. resigned, expired or taken over,
+//     then metadata is deleted and publish to changed channel
+//  3. leader: metadata is valid only if its owner still holds the lock
+//  4. observe: load leader once changed channel is notified,
+//     or every observe interval in case of leader is crashed
+type Election interface {
+	// Campaign block until elected as leader
+	//
+	// leaderCtx is derived from ctx, will be set to done when leadership is ended.
+	// return current leaderCtx if already elected.
+	//
+	// concurrent campaigns are serialized, they share the same leadership.
+	Campaign(ctx context.Context) (leaderCtx context.Context, err error)
+	// Resign give up leadership,
+	// return ErrLockNotHeld if not leader
+	Resign(ctx context.Context) error
+	// Leader get current leader, return ErrNoLeader if there is no leader
+	Leader(ctx context.Context) (*LeaderInfo, error)
+	// Observe stream leader changes until ctx done,
+	// current leader is sent first, nil means there is no leader.
+	Observe(ctx context.Context) <-chan *LeaderInfo
+}
+
+type electionOption struct {
+	address         string
+	ttl             time.Duration
+	observeInterval time.Duration
+	onLost          func(reason error)
+}
+
+type election struct {
+	electionOption
+	rdb    *Utils
+	logger gutils.LoggerItf
+	mu     *mutex
+
+	name,
+	candidateID,
+	// leader leader's metadata
+	leader,
+	// channel pub/sub channel to notify leader changed
+	channel string
+
+	// campaigning token held by the running campaign,
+	// concurrent campaigns wait for it then reuse its leadership
+	campaigning chan struct{}
+
+	handleMu sync.Mutex
+	// handle lock handle of current leadership
+	handle *lockHandle
+}
+
+// ElectionOptionFunc options for election
+type ElectionOptionFunc func(*election) error
+
+// WithElectionAddress set address of candidate, default is hostname
+func WithElectionAddress(address string) ElectionOptionFunc {
+	return func(e *election) error {
+		e.address = address
+		return nil
+	}
+}
+
+// WithElectionTTL set ttl of leader's lock,
+// leadership is lost if leader failed to refresh lock within ttl
+func WithElectionTTL(ttl time.Duration) ElectionOptionFunc {
+	return func(e *election) error {
+		if ttl <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "ttl must greater than 0")
+		}
+
+		e.ttl = ttl
+		return nil
+	}
+}
+
+// WithElectionObserveInterval set interval to reload leader in `Observe`,
+// in case of leader is crashed without notification
+func WithElectionObserveInterval(interval time.Duration) ElectionOptionFunc {
+	return func(e *election) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "observe interval must greater than 0")
+		}
+
+		e.observeInterval = interval
+		return nil
+	}
+}
+
+// WithElectionOnLost set callback called once when leadership is ended,
+// reasons are the same as `WithMutexOnLost`
+func WithElectionOnLost(onLost func(reason error)) ElectionOptionFunc {
+	return func(e *election) error {
+		e.onLost = onLost
+		return nil
+	}
+}
+
+// WithElectionLogger set election's logger
+func WithElectionLogger(logger *gutils.LoggerType) ElectionOptionFunc {
+	return func(e *election) error {
+		e.logger = logger
+		return nil
+	}
+}
+
+// NewElection new leader election
+//
+// candidates campaign in the same election by the same name,
+// candidateID identifies this candidate in `LeaderInfo`.
+func (u *Utils) NewElection(name, candidateID string, opts ...ElectionOptionFunc) (Election, error) {
+	if name == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, "name must not be empty")
+	}
+	if candidateID == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, "candidateID must not be empty")
+	}
+
+	e := &election{
+		rdb:         u,
+		logger:      u.logger,
+		name:        name,
+		candidateID: candidateID,
+		campaigning: make(chan struct{}, 1),
+		leader:      u.buildKey(defaultKeySyncElectionLeader, name),
+		channel:     u.buildKey(defaultKeySyncElectionChanged, name),
+		electionOption: electionOption{
+			observeInterval: defaultElectionObserveInterval,
+		},
+	}
+	e.address, _ = os.Hostname()
+	for _, optf := range opts {
+		if err := optf(e); err != nil {
+			return nil, err
+		}
+	}
+
+	muOpts := []MutexOptionFunc{
+		WithMutexClientID(candidateID),
+		WithMutexOnLost(e.onLost),
+	}
+	if e.ttl != 0 {
+		muOpts = append(muOpts,
+			WithMutexTTL(e.ttl),
+			WithMutexRefreshInterval(e.ttl/3))
+	}
+
+	mu, err := u.NewMutex(name, muOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu = mu.(*mutex)
+	e.mu.logger = e.logger
+	return e, nil
+}
+
+// Campaign block until elected as leader
+func (e *election) Campaign(ctx context.Context) (leaderCtx context.Context, err error) {
+	defer func(start time.Time) {
+		e.rdb.observe(ctx, "election", e.name, "campaign", start, err == nil, err)
+	}(time.Now())
+
+	select {
+	case e.campaigning <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-e.campaigning }()
+
+	e.handleMu.Lock()
+	if e.handle != nil && e.handle.Ctx().Err() == nil {
+		leaderCtx = e.handle.Ctx()
+		e.handleMu.Unlock()
+		return leaderCtx, nil
+	}
+	e.handleMu.Unlock()
+
+	handle, err := e.mu.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	h := handle.(*lockHandle)
+	ok, err := electionPromoteScript.Run(ctx, e.rdb,
+		[]string{e.mu.name, e.leader},
+		h.cid,
+		e.candidateID,
+		e.address,
+		e.rdb.clock.GetUTCNow().UnixMilli(),
+		e.channel,
+	).Bool()
+	if err != nil || !ok {
+		if uerr := h.Unlock(context.Background()); uerr != nil {
+			e.logger.Debug("release lock of failed campaign", zap.Error(uerr))
+		}
+		if err == nil {
+			err = ErrLockNotHeld
+		}
+
+		return nil, errors.Wrapf(err, "save leader of election `%s`", e.name)
+	}
+
+	e.handleMu.Lock()
+	e.handle = h
+	e.handleMu.Unlock()
+
+	e.logger.Info("elected as leader",
+		zap.String("election", e.name), zap.String("candidate", e.candidateID))
+	go e.watch(h)
+	return h.Ctx(), nil
+}
+
+// watch clean up leader's metadata once leadership is ended
+func (e *election) watch(h *lockHandle) {
+	<-h.Ctx().Done()
+
+	e.handleMu.Lock()
+	if e.handle == h {
+		e.handle = nil
+	}
+	e.handleMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), electionCleanupTimeout)
+	defer cancel()
+	if err := electionCleanupScript.Run(ctx, e.rdb,
+		[]string{e.leader}, h.cid, e.channel).Err(); err != nil {
+		e.logger.Warn("clean up leader", zap.String("election", e.name), zap.Error(err))
+	}
+
+	e.logger.Info("leadership ended",
+		zap.String("election", e.name), zap.String("candidate", e.candidateID))
+}
+
+// Resign give up leadership
+func (e *election) Resign(ctx context.Context) error {
+	e.handleMu.Lock()
+	h := e.handle
+	e.handleMu.Unlock()
+	if h == nil {
+		return ErrLockNotHeld
+	}
+
+	return h.Unlock(ctx)
+}
+
+// Leader get current leader
+func (e *election) Leader(ctx context.Context) (*LeaderInfo, error) {
+	ret, err := electionLeaderScript.Run(ctx, e.rdb,
+		[]string{e.mu.name, e.leader}).Slice()
+	if IsNil(err) {
+		return nil, ErrNoLeader
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "load leader of election `%s`", e.name)
+	}
+
+	info := &LeaderInfo{}
+	info.ID, _ = ret[0].(string)
+	info.Address, _ = ret[1].(string)
+	if since, ok := ret[2].(string); ok {
+		ms, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse since `%s`", since)
+		}
+
+		info.Since = time.UnixMilli(ms).UTC()
+	}
+
+	return info, nil
+}
+
+// Observe stream leader changes until ctx done
+func (e *election) Observe(ctx context.Context) <-chan *LeaderInfo {
+	ch := make(chan *LeaderInfo)
+	go func() {
+		defer close(ch)
+		waiter := &lockWaiter{
+			rdb:              e.rdb,
+			logger:           e.logger,
+			channel:          e.channel,
+			spinInterval:     e.observeInterval,
+			fallbackInterval: e.observeInterval,
+		}
+		defer waiter.close()
+
+		var (
+			last *LeaderInfo
+			sent bool
+		)
+		for {
+			info, err := e.Leader(ctx)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil && !errors.Is(err, ErrNoLeader):
+				e.logger.Warn("load leader", zap.String("election", e.name), zap.Error(err))
+			case !sent || !sameLeader(last, info):
+				select {
+				case ch <- info:
+				case <-ctx.Done():
+					return
+				}
+
+				last, sent = info, true
+			}
+
+			waiter.wait(ctx)
+		}
+	}()
+
+	return ch
+}
+
+// sameLeader whether a and b are the same leadership
+func sameLeader(a, b *LeaderInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.ID == b.ID && a.Since.Equal(b.Since)
+}
@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewElection(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := rtils.NewElection("", "c1")
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewElection("laisky", "")
+	require.ErrorIs(t, err, ErrInvalidArgument)
+
+	name := "laisky" + gutils.RandomStringWithLength(10)
+	e1, err := rtils.NewElection(name, "c1", WithElectionAddress("10.0.0.1:8080"))
+	require.NoError(t, err)
+	e2, err := rtils.NewElection(name, "c2",
+		WithElectionAddress("10.0.0.2:8080"),
+		WithElectionObserveInterval(100*time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = e1.Leader(ctx)
+	require.ErrorIs(t, err, ErrNoLeader)
+	require.ErrorIs(t, e1.Resign(ctx), ErrLockNotHeld)
+
+	observeCtx, cancelObserve := context.WithCancel(ctx)
+	defer cancelObserve()
+	changes := e2.Observe(observeCtx)
+	require.Nil(t, <-changes)
+
+	leaderCtx, err := e1.Campaign(ctx)
+	require.NoError(t, err)
+	leader, err := e2.Leader(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "c1", leader.ID)
+	require.Equal(t, "10.0.0.1:8080", leader.Address)
+	require.False(t, leader.Since.IsZero())
+	require.Equal(t, "c1", (<-changes).ID)
+
+	// campaign again returns current leadership
+	again, err := e1.Campaign(ctx)
+	require.NoError(t, err)
+	require.Equal(t, leaderCtx, again)
+
+	// c2 waits until c1 resigns
+	elected := make(chan context.Context)
+	go func() {
+		leaderCtx, err := e2.Campaign(ctx)
+		require.NoError(t, err)
+		elected <- leaderCtx
+	}()
+
+	select {
+	case <-elected:
+		t.Fatal("should not be elected")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	require.NoError(t, e1.Resign(ctx))
+	require.Error(t, leaderCtx.Err())
+	leader2Ctx := <-elected
+	require.NoError(t, leader2Ctx.Err())
+
+	// observer may see no leader between two leaderships
+	for info := range changes {
+		if info != nil {
+			require.Equal(t, "c2", info.ID)
+			require.Equal(t, "10.0.0.2:8080", info.Address)
+			break
+		}
+	}
+
+	leader, err = e1.Leader(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "c2", leader.ID)
+
+	// leadership ends once lock is lost
+	require.NoError(t, rdb.Del(ctx, rtils.buildKey(defaultKeySyncMutex, name)).Err())
+	_, err = e1.Leader(ctx)
+	require.ErrorIs(t, err, ErrNoLeader)
+	require.Nil(t, <-changes)
+	<-leader2Ctx.Done()
+}
+
+func TestUtils_NewElection_concurrentCampaign(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := "laisky" + gutils.RandomStringWithLength(10)
+	e1, err := rtils.NewElection(name, "c1")
+	require.NoError(t, err)
+
+	leaderCtxs := make(chan context.Context, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leaderCtx, err := e1.Campaign(ctx)
+			if err != nil {
+				t.Errorf("campaign: %v", err)
+				return
+			}
+
+			leaderCtxs <- leaderCtx
+		}()
+	}
+	wg.Wait()
+	close(leaderCtxs)
+
+	// all campaigns share the same leadership
+	first := <-leaderCtxs
+	require.NotNil(t, first)
+	for leaderCtx := range leaderCtxs {
+		require.Equal(t, first, leaderCtx)
+	}
+
+	// leadership is released by one resign
+	require.NoError(t, e1.Resign(ctx))
+	require.Error(t, first.Err())
+
+	e2, err := rtils.NewElection(name, "c2")
+	require.NoError(t, err)
+	campaignCtx, campaignCancel := context.WithTimeout(ctx, time.Second)
+	defer campaignCancel()
+	_, err = e2.Campaign(campaignCtx)
+	require.NoError(t, err)
+	require.NoError(t, e2.Resign(ctx))
+}
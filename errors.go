@@ -1,6 +1,8 @@
 package redis
 
 import (
+	"fmt"
+
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
 )
@@ -9,3 +11,55 @@ import (
 func IsNil(err error) bool {
 	return errors.Is(err, redis.Nil)
 }
+
+// ErrCacheNotFound returned by `CacheLoader` if data not exists in data source,
+// the negative result will be cached for a short ttl.
+var ErrCacheNotFound = errors.New("cache: not found")
+
+var (
+	// ErrLockNotHeld lock is not held by this client,
+	// e.g. Unlock without Lock, or lock is expired.
+	//
+	// `*ErrLockLost` matches ErrLockNotHeld as well.
+	ErrLockNotHeld = errors.New("lock: not held")
+	// ErrLockExpired lock is expired, matches ErrLockNotHeld as well
+	ErrLockExpired = fmt.Errorf("%w: expired", ErrLockNotHeld)
+	// ErrLockUnreachable lock could not be refreshed before ttl deadline,
+	// e.g. redis is unreachable, matches ErrLockNotHeld as well
+	ErrLockUnreachable = fmt.Errorf("%w: unreachable", ErrLockNotHeld)
+	// ErrLockReleased lock has been released by unlock
+	ErrLockReleased = errors.New("lock: released")
+	// ErrNotAcquired non-blocking acquisition failed,
+	// or acked/nacked queue message is not held by this consumer
+	ErrNotAcquired = errors.New("lock: not acquired")
+	// ErrLockTaken non-blocking acquisition failed since lock is held by another client,
+	// matches ErrNotAcquired as well
+	ErrLockTaken = fmt.Errorf("%w: taken by another client", ErrNotAcquired)
+	// ErrLockUpgrade read lock holder could not acquire write lock
+	// while other readers are holding the read lock, matches ErrNotAcquired as well
+	ErrLockUpgrade = fmt.Errorf("%w: read lock is shared with other readers", ErrNotAcquired)
+	// ErrNoLeader election has no leader currently
+	ErrNoLeader = errors.New("election: no leader")
+	// ErrInvalidSnapshotID snapshot id of rank is out of range
+	ErrInvalidSnapshotID = errors.New("rank: invalid snapshot id")
+	// ErrInvalidArgument invalid argument
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+// ErrLockLost lock is taken over by another client
+type ErrLockLost struct {
+	// Lock key of lock
+	Lock string
+	// Owner client id of current owner
+	Owner string
+}
+
+// Error implement error
+func (e *ErrLockLost) Error() string {
+	return fmt.Sprintf("lock: `%s` taken over by `%s`", e.Lock, e.Owner)
+}
+
+// Is match ErrLockNotHeld
+func (e *ErrLockLost) Is(target error) bool {
+	return target == ErrLockNotHeld
+}
@@ -7,23 +7,34 @@ package redis
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"strings"
 	"time"
 
+	gutils "github.com/Laisky/go-utils"
 	"github.com/go-redis/redis/v8"
 
 	"github.com/Laisky/zap"
 	"github.com/pkg/errors"
 )
 
+const (
+	// defaultGetItemBlockingNotifyFallbackInterval poll interval of `GetItemBlocking`
+	// when waiting by keyspace notifications
+	defaultGetItemBlockingNotifyFallbackInterval = 10 * time.Second
+)
+
 // GetItem get item from redis
 func (u *Utils) GetItem(ctx context.Context, key string) (string, error) {
 	u.logger.Debug("get redis item", zap.String("key", key))
-	return u.Client.Get(ctx, key).Result()
+	return u.UniversalClient.Get(ctx, key).Result()
 }
 
 type getItemBlockingOption struct {
-	del bool
+	del,
+	keyspaceNotify,
+	enableKeyspaceNotify bool
+	pollInterval,
+	notifyFallbackInterval time.Duration
 }
 
 // GetItemBlockingOptionFunc optional arguments for GetItemBlocking
@@ -37,12 +48,165 @@ func (u *Utils) WithGetItemBlockingDel(del bool) GetItemBlockingOptionFunc {
 	}
 }
 
+// WithGetItemBlockingPollInterval set interval of polling key,
+// default is `WaitDBKeyDuration`
+func (u *Utils) WithGetItemBlockingPollInterval(interval time.Duration) GetItemBlockingOptionFunc {
+	return func(opt *getItemBlockingOption) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "poll interval must greater than 0")
+		}
+
+		opt.pollInterval = interval
+		return nil
+	}
+}
+
+// WithGetItemBlockingKeyspaceNotify whether to wait key by keyspace notifications instead of polling.
+//
+// falls back to polling if keyspace notifications are not enabled on server,
+// use `WithGetItemBlockingEnableKeyspaceNotify` to enable them.
+//
+// for cluster, subscribes the master owns the key, for ring, subscribes all shards.
+func (u *Utils) WithGetItemBlockingKeyspaceNotify(notify bool) GetItemBlockingOptionFunc {
+	return func(opt *getItemBlockingOption) error {
+		opt.keyspaceNotify = notify
+		return nil
+	}
+}
+
+// WithGetItemBlockingEnableKeyspaceNotify whether to set `notify-keyspace-events` on server
+// when it is disabled, only works with `WithGetItemBlockingKeyspaceNotify(true)`
+func (u *Utils) WithGetItemBlockingEnableKeyspaceNotify(enable bool) GetItemBlockingOptionFunc {
+	return func(opt *getItemBlockingOption) error {
+		opt.enableKeyspaceNotify = enable
+		return nil
+	}
+}
+
+// WithGetItemBlockingNotifyFallbackInterval set interval of polling key
+// when waiting by keyspace notifications, in case of notification is lost
+func (u *Utils) WithGetItemBlockingNotifyFallbackInterval(interval time.Duration) GetItemBlockingOptionFunc {
+	return func(opt *getItemBlockingOption) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "fallback interval must greater than 0")
+		}
+
+		opt.notifyFallbackInterval = interval
+		return nil
+	}
+}
+
+// KeyspaceNotifyEnabled check whether keyspace notifications of string commands
+// are enabled on server, by `CONFIG GET notify-keyspace-events`.
+//
+// if enable is true, will enable them by `CONFIG SET` when they are disabled.
+//
+// notifications are published on the node owns the key,
+// so every master of cluster and every shard of ring are checked,
+// return true only if all of them are enabled.
+func (u *Utils) KeyspaceNotifyEnabled(ctx context.Context, enable bool) (enabled bool, err error) {
+	shards, err := u.shards(ctx)
+	if err != nil {
+		return false, err
+	}
+	if len(shards) == 0 {
+		return keyspaceNotifyEnabled(ctx, u.UniversalClient, u.logger, enable)
+	}
+
+	for _, rdb := range shards {
+		if enabled, err = keyspaceNotifyEnabled(ctx, rdb, u.logger, enable); err != nil || !enabled {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// keyspaceNotifyEnabled check and enable keyspace notifications on one node
+func keyspaceNotifyEnabled(ctx context.Context, rdb redis.Cmdable,
+	logger gutils.LoggerItf, enable bool) (enabled bool, err error) {
+	ret, err := rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return false, errors.Wrap(err, "get notify-keyspace-events")
+	}
+
+	var flags string
+	if len(ret) == 2 {
+		flags, _ = ret[1].(string)
+	}
+
+	enabled = strings.Contains(flags, "K") &&
+		(strings.Contains(flags, "A") || strings.Contains(flags, "$"))
+	if enabled || !enable {
+		return enabled, nil
+	}
+
+	for _, flag := range []string{"K", "$", "g"} {
+		if !strings.Contains(flags, flag) {
+			flags += flag
+		}
+	}
+
+	if err = rdb.ConfigSet(ctx, "notify-keyspace-events", flags).Err(); err != nil {
+		return false, errors.Wrapf(err, "set notify-keyspace-events to `%s`", flags)
+	}
+
+	logger.Info("enable keyspace notifications", zap.String("flags", flags))
+	return true, nil
+}
+
+// keyspaceChannel keyspace notification channel of key in db
+func keyspaceChannel(db int, key string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", db, key)
+}
+
+// keyspaceSubscriptions keyspace notification channels of key on the nodes
+// where notifications of key may be published.
+//
+//   - client: itself
+//   - cluster: the master owns the slot of key
+//   - ring: every shard, since the shard of key is not exposed by ring
+func (u *Utils) keyspaceSubscriptions(ctx context.Context, key string) (subs []waiterSubscription, err error) {
+	var nodes []*redis.Client
+	switch rdb := u.UniversalClient.(type) {
+	case *redis.Client:
+		nodes = append(nodes, rdb)
+	case *redis.ClusterClient:
+		node, err := rdb.MasterForKey(ctx, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get master of key `%s`", key)
+		}
+
+		nodes = append(nodes, node)
+	case *redis.Ring:
+		if nodes, err = u.shards(ctx); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("keyspace notifications are not supported by `%T`", rdb)
+	}
+
+	for _, node := range nodes {
+		subs = append(subs, waiterSubscription{
+			client:  node,
+			channel: keyspaceChannel(node.Options().DB, key),
+		})
+	}
+
+	return subs, nil
+}
+
 // GetItemBlocking get key blocking
 //
 // will delete key after get in default.
+//
+// polls key every `WaitDBKeyDuration` in default,
+// use `WithGetItemBlockingKeyspaceNotify` to wake up once key is changed.
 func (u *Utils) GetItemBlocking(ctx context.Context, dbkey string, opts ...GetItemBlockingOptionFunc) (data string, err error) {
 	opt := &getItemBlockingOption{
-		del: true,
+		del:                    true,
+		pollInterval:           WaitDBKeyDuration,
+		notifyFallbackInterval: defaultGetItemBlockingNotifyFallbackInterval,
 	}
 	for _, optf := range opts {
 		if err := optf(opt); err != nil {
@@ -50,6 +214,32 @@ func (u *Utils) GetItemBlocking(ctx context.Context, dbkey string, opts ...GetIt
 		}
 	}
 
+	waiter := &lockWaiter{
+		rdb:              u,
+		logger:           u.logger,
+		channel:          keyspaceChannel(0, dbkey),
+		spinInterval:     opt.pollInterval,
+		fallbackInterval: opt.notifyFallbackInterval,
+		disabled:         true,
+	}
+	if opt.keyspaceNotify {
+		var enabled bool
+		waiter.subscriptions, err = u.keyspaceSubscriptions(ctx, dbkey)
+		if err == nil {
+			enabled, err = u.KeyspaceNotifyEnabled(ctx, opt.enableKeyspaceNotify)
+		}
+		if err != nil {
+			u.logger.Warn("check keyspace notifications, fallback to polling",
+				zap.String("key", dbkey), zap.Error(err))
+		} else if !enabled {
+			u.logger.Warn("keyspace notifications disabled, fallback to polling",
+				zap.String("key", dbkey))
+		}
+
+		waiter.disabled = err != nil || !enabled
+	}
+	defer waiter.close()
+
 	var got bool
 	for {
 		select {
@@ -59,9 +249,9 @@ func (u *Utils) GetItemBlocking(ctx context.Context, dbkey string, opts ...GetIt
 		}
 
 		if !opt.del {
-			if data, err = u.Client.Get(ctx, dbkey).Result(); err != nil {
+			if data, err = u.UniversalClient.Get(ctx, dbkey).Result(); err != nil {
 				if IsNil(err) {
-					time.Sleep(WaitDBKeyDuration)
+					waiter.wait(ctx)
 					continue
 				}
 
@@ -72,138 +262,501 @@ func (u *Utils) GetItemBlocking(ctx context.Context, dbkey string, opts ...GetIt
 		}
 
 		got = false
-		err = u.Client.Watch(ctx, func(tx *redis.Tx) (err error) {
+		err = u.UniversalClient.Watch(ctx, func(tx *redis.Tx) (err error) {
 			if data, err = tx.Get(ctx, dbkey).Result(); err != nil {
 				return err
 			}
-			got = true
-
-			// ====================================
-			// test
-			// ====================================
-			// time.Sleep(100 * time.Millisecond)
-			// runtime.Gosched()
-			// if data2, err := u.Client.Get(ctx, dbkey).Result(); err != nil {
-			// 	return err
-			// } else {
-			// 	fmt.Println(data2)
-			// 	time.Sleep(time.Second)
-			// }
-			// ====================================
 
 			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) (err error) {
 				return p.Del(ctx, dbkey).Err()
 			})
 			if err != nil {
-				u.logger.Error("del", zap.Error(err))
+				return err
 			}
 
+			got = true
 			return nil
 		}, dbkey)
 
 		if got {
 			return data, nil
-		} else if err != nil {
-			time.Sleep(WaitDBKeyDuration)
+		} else if errors.Is(err, redis.TxFailedErr) {
+			// key changed by others between get and del, retry immediately
 			continue
+		} else if err != nil && !IsNil(err) {
+			u.logger.Error("get and del", zap.String("key", dbkey), zap.Error(err))
 		}
-	}
 
+		waiter.wait(ctx)
+	}
 }
 
 // SetItem set item
 func (u *Utils) SetItem(ctx context.Context, key, val string, exp time.Duration) error {
 	u.logger.Debug("put redis item", zap.String("key", key))
-	return u.Client.Set(ctx, key, val, exp).Err()
+	return u.UniversalClient.Set(ctx, key, val, exp).Err()
 }
 
 // GetItemWithPrefix get item with prefix, return `map[key]: val`
+//
+// load all items into memory, use `ScanItems` for large prefix.
 func (u *Utils) GetItemWithPrefix(ctx context.Context, keyPrefix string) (map[string]string, error) {
 	u.logger.Debug("get redis item with prefix", zap.String("key_prefix", keyPrefix))
 	if keyPrefix == "" {
-		return nil, fmt.Errorf("do not scan all keys")
+		return nil, errors.Wrap(ErrInvalidArgument, "do not scan all keys")
 	}
 
-	var (
-		err           error
-		keys, newKeys []string
-		cursor        uint64
-	)
-	for {
-		if newKeys, cursor, err = u.Client.Scan(ctx, cursor, keyPrefix+"*", ScanCount).Result(); err != nil {
-			return nil, errors.Wrapf(err, "scan redis with key_prefix `%s`", keyPrefix)
+	iter, err := u.ScanItems(keyPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	item := make(map[string]string)
+	for iter.Next(ctx) {
+		item[iter.Key()] = iter.Val()
+	}
+	if err = iter.Err(); err != nil {
+		return nil, errors.Wrapf(err, "scan redis with key_prefix `%s`", keyPrefix)
+	}
+
+	return item, nil
+}
+
+const (
+	defaultScanItemsBatchSize = 100
+)
+
+type scanItemsOption struct {
+	count     int64
+	batchSize int
+	keyType   string
+}
+
+// ScanItemsOptionFunc optional arguments for ScanItems
+type ScanItemsOptionFunc func(*scanItemsOption) error
+
+// WithScanItemsCount set `COUNT` of each `SCAN`, default is `ScanCount`
+func (u *Utils) WithScanItemsCount(count int64) ScanItemsOptionFunc {
+	return func(opt *scanItemsOption) error {
+		if count <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "count must greater than 0")
 		}
 
-		keys = append(keys, newKeys...)
-		if cursor == 0 {
-			break
+		opt.count = count
+		return nil
+	}
+}
+
+// WithScanItemsBatchSize set max keys of each `MGET`
+func (u *Utils) WithScanItemsBatchSize(size int) ScanItemsOptionFunc {
+	return func(opt *scanItemsOption) error {
+		if size <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "batch size must greater than 0")
 		}
+
+		opt.batchSize = size
+		return nil
 	}
+}
 
-	item := make(map[string]string)
-	if len(keys) == 0 {
-		return item, nil
+// WithScanItemsType set `TYPE` of `SCAN`, default is no type filter.
+//
+// `TYPE` requires redis 6.0, it is ignored on older servers.
+// non-string keys are always skipped, since values are loaded by `MGET`.
+func (u *Utils) WithScanItemsType(keyType string) ScanItemsOptionFunc {
+	return func(opt *scanItemsOption) error {
+		opt.keyType = keyType
+		return nil
+	}
+}
+
+// ItemIterator iterate items scanned by `ScanItems`
+//
+//	iter, err := rtils.ScanItems("prefix/*")
+//	for iter.Next(ctx) {
+//		key, val := iter.Key(), iter.Val()
+//	}
+//	err = iter.Err()
+type ItemIterator struct {
+	scanItemsOption
+	rdb   *Utils
+	match string
+
+	// started whether nodes are loaded
+	started bool
+	// nodes nodes not finished scanning yet
+	nodes  []redis.Cmdable
+	cursor uint64
+	keys   []string
+
+	items   []scanItem
+	current scanItem
+	err     error
+}
+
+type scanItem struct {
+	key, val string
+}
+
+// ScanItems scan keys match glob pattern,
+// then get items by `MGET` in bounded batches.
+//
+// for redis cluster and ring, all masters/shards are scanned one by one,
+// and items are loaded by pipelined `GET`, since keys may be in different slots.
+func (u *Utils) ScanItems(match string, opts ...ScanItemsOptionFunc) (*ItemIterator, error) {
+	if match == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, "match must not be empty")
+	}
+
+	iter := &ItemIterator{
+		rdb:   u,
+		match: match,
+		scanItemsOption: scanItemsOption{
+			count:     ScanCount,
+			batchSize: defaultScanItemsBatchSize,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(&iter.scanItemsOption); err != nil {
+			return nil, err
+		}
 	}
 
-	res, err := u.Client.MGet(ctx, keys...).Result()
+	return iter, nil
+}
+
+// Next advance to next item, return false if no more items or error occurred
+func (it *ItemIterator) Next(ctx context.Context) bool {
+	for len(it.items) == 0 {
+		if it.err != nil {
+			return false
+		}
+
+		if err := it.fetch(ctx); err != nil {
+			it.err = err
+			return false
+		}
+
+		if len(it.items) == 0 && it.done() && len(it.keys) == 0 {
+			return false
+		}
+	}
+
+	it.current, it.items = it.items[0], it.items[1:]
+	return true
+}
+
+// done whether all nodes are scanned
+func (it *ItemIterator) done() bool {
+	return it.started && len(it.nodes) == 0
+}
+
+// start load nodes to scan
+func (it *ItemIterator) start(ctx context.Context) error {
+	shards, err := it.rdb.shards(ctx)
 	if err != nil {
-		return nil, errors.Wrapf(err, "mget keys `%v`", keys)
+		return err
 	}
 
-	for i, v := range res {
-		if v == nil {
-			continue
+	if shards == nil {
+		it.nodes = []redis.Cmdable{it.rdb.UniversalClient}
+	} else {
+		for _, shard := range shards {
+			it.nodes = append(it.nodes, shard)
 		}
+	}
 
-		item[keys[i]] = v.(string)
+	if it.keyType != "" && !it.rdb.supports(ctx, capScanType) {
+		it.rdb.logger.Debug("SCAN TYPE is not supported, ignore type filter",
+			zap.String("type", it.keyType))
+		it.keyType = ""
 	}
 
-	return item, nil
+	it.started = true
+	return nil
+}
+
+// fetch scan keys until got a batch, then load them
+func (it *ItemIterator) fetch(ctx context.Context) (err error) {
+	if !it.started {
+		if err = it.start(ctx); err != nil {
+			return err
+		}
+	}
+
+	for len(it.keys) < it.batchSize && !it.done() {
+		var keys []string
+		if it.keyType == "" {
+			keys, it.cursor, err = it.nodes[0].Scan(ctx, it.cursor, it.match, it.count).Result()
+		} else {
+			keys, it.cursor, err = it.nodes[0].ScanType(ctx, it.cursor, it.match, it.count, it.keyType).Result()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "scan `%s`", it.match)
+		}
+
+		it.keys = append(it.keys, keys...)
+		if it.cursor == 0 {
+			it.nodes = it.nodes[1:]
+		}
+	}
+
+	if len(it.keys) == 0 {
+		return nil
+	}
+
+	n := it.batchSize
+	if n > len(it.keys) {
+		n = len(it.keys)
+	}
+
+	keys := it.keys[:n]
+	it.keys = it.keys[n:]
+	vals, err := it.rdb.mget(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range vals {
+		// nil if key is expired or not string
+		if v, ok := v.(string); ok {
+			it.items = append(it.items, scanItem{key: keys[i], val: v})
+		}
+	}
+
+	return nil
+}
+
+// mget load values of keys, nil if key is not exists or not string.
+//
+// keys may be located in different nodes of cluster or ring,
+// then they are loaded by pipelined `GET` instead of `MGET`.
+func (u *Utils) mget(ctx context.Context, keys []string) ([]interface{}, error) {
+	switch u.UniversalClient.(type) {
+	case *redis.ClusterClient, *redis.Ring:
+	default:
+		vals, err := u.UniversalClient.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, errors.Wrapf(err, "mget %d keys", len(keys))
+		}
+
+		return vals, nil
+	}
+
+	pipe := u.UniversalClient.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
+	_, _ = pipe.Exec(ctx) // errors are checked by each cmd
+
+	vals := make([]interface{}, len(keys))
+	for i, cmd := range cmds {
+		val, err := cmd.Result()
+		switch {
+		case err == nil:
+			vals[i] = val
+		case IsNil(err) || strings.HasPrefix(err.Error(), "WRONGTYPE"):
+		default:
+			return nil, errors.Wrapf(err, "get `%s`", keys[i])
+		}
+	}
+
+	return vals, nil
+}
+
+// Key key of current item
+func (it *ItemIterator) Key() string {
+	return it.current.key
+}
+
+// Val value of current item
+func (it *ItemIterator) Val() string {
+	return it.current.val
+}
+
+// Err error occurred during iteration
+func (it *ItemIterator) Err() error {
+	return it.err
 }
 
 // LPopKeysBlocking LPop from mutiple keys
+//
+// block until any key is not empty, keys are checked in order.
+// in cluster mode, all keys must be in the same slot.
 func (u *Utils) LPopKeysBlocking(ctx context.Context, keys ...string) (key, val string, err error) {
+	key, vals, err := u.popKeysBlocking(ctx, true, 1, keys)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, vals[0], nil
+}
+
+// LPopKeysBlockingN LPop at most n items from the first non-empty key
+func (u *Utils) LPopKeysBlockingN(ctx context.Context, n int, keys ...string) (key string, vals []string, err error) {
+	return u.popKeysBlocking(ctx, true, n, keys)
+}
+
+// RPopKeysBlocking RPop from mutiple keys
+//
+// block until any key is not empty, keys are checked in order.
+// in cluster mode, all keys must be in the same slot.
+func (u *Utils) RPopKeysBlocking(ctx context.Context, keys ...string) (key, val string, err error) {
+	key, vals, err := u.popKeysBlocking(ctx, false, 1, keys)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, vals[0], nil
+}
+
+// RPopKeysBlockingN RPop at most n items from the first non-empty key
+func (u *Utils) RPopKeysBlockingN(ctx context.Context, n int, keys ...string) (key string, vals []string, err error) {
+	return u.popKeysBlocking(ctx, false, n, keys)
+}
+
+// popKeysBlocking pop at most n items from the first non-empty key
+//
+// use `BLMPOP` on redis 7, otherwise `BLPOP`/`BRPOP` then pop the rest items.
+// block timeout is split into chunks of `WaitDBKeyDuration` to check ctx.
+func (u *Utils) popKeysBlocking(ctx context.Context, left bool, n int, keys []string) (key string, vals []string, err error) {
+	if len(keys) == 0 {
+		return "", nil, errors.Wrap(ErrInvalidArgument, "keys must not be empty")
+	}
+	if n <= 0 {
+		return "", nil, errors.Wrap(ErrInvalidArgument, "n must greater than 0")
+	}
+
+	blmpop := u.supports(ctx, capBLMPop)
 	for {
 		select {
 		case <-ctx.Done():
-			return "", "", errors.Wrapf(ctx.Err(), "lpop `%v`", keys)
+			return "", nil, errors.Wrapf(ctx.Err(), "pop `%v`", keys)
 		default:
 		}
 
-		for _, key = range keys {
-			if val, err = u.Client.LPop(ctx, key).Result(); err != nil {
-				if !IsNil(err) {
-					return "", "", errors.Wrapf(err, "lpop `%v`", keys)
-				}
-
+		if blmpop {
+			key, vals, err = u.blmpop(ctx, left, n, keys)
+		} else {
+			key, vals, err = u.bpop(ctx, left, n, keys)
+		}
+		if err != nil {
+			if IsNil(err) {
 				continue
 			}
+			if ctx.Err() != nil {
+				return "", nil, errors.Wrapf(ctx.Err(), "pop `%v`", keys)
+			}
 
-			return key, val, nil
+			return "", nil, errors.Wrapf(err, "pop `%v`", keys)
 		}
 
-		time.Sleep(WaitDBKeyDuration)
+		return key, vals, nil
 	}
 }
 
-// RPush rpush keys and truncate its length
-//
-// default max length is 100
-func (u *Utils) RPush(ctx context.Context, key string, payloads ...interface{}) (err error) {
-	var length int64
-	if rand.Intn(100) == 0 {
-		if length, err = u.Client.LLen(ctx, key).Result(); err != nil {
-			return errors.Wrapf(err, "get len `%s`", key)
+// blmpop pop at most n items by `BLMPOP`
+func (u *Utils) blmpop(ctx context.Context, left bool, n int, keys []string) (key string, vals []string, err error) {
+	direction := "LEFT"
+	if !left {
+		direction = "RIGHT"
+	}
+
+	args := []interface{}{"BLMPOP", WaitDBKeyDuration.Seconds(), len(keys)}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, direction, "COUNT", n)
+
+	// reply: [key, [item, ...]]
+	ret, err := u.Do(ctx, args...).Slice()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(ret) != 2 {
+		return "", nil, errors.Errorf("unknown blmpop reply `%v`", ret)
+	}
+
+	key, _ = ret[0].(string)
+	items, _ := ret[1].([]interface{})
+	for _, item := range items {
+		v, _ := item.(string)
+		vals = append(vals, v)
+	}
+
+	return key, vals, nil
+}
+
+// bpop pop one item by `BLPOP`/`BRPOP`, then pop the rest n-1 items
+// from the same key without blocking, by `LPOP key count` on redis 6.2
+// or pipelined `LPOP` on older servers
+func (u *Utils) bpop(ctx context.Context, left bool, n int, keys []string) (key string, vals []string, err error) {
+	var ret []string
+	if left {
+		ret, err = u.UniversalClient.BLPop(ctx, WaitDBKeyDuration, keys...).Result()
+	} else {
+		ret, err = u.UniversalClient.BRPop(ctx, WaitDBKeyDuration, keys...).Result()
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, vals = ret[0], []string{ret[1]}
+	if n == 1 {
+		return key, vals, nil
+	}
+
+	if u.supports(ctx, capPopCount) {
+		var rest []string
+		if left {
+			rest, err = u.UniversalClient.LPopCount(ctx, key, n-1).Result()
+		} else {
+			rest, err = u.UniversalClient.RPopCount(ctx, key, n-1).Result()
+		}
+		if err != nil && !IsNil(err) {
+			// item already popped, return it anyway
+			u.logger.Error("pop rest items", zap.String("key", key), zap.Error(err))
 		}
+
+		return key, append(vals, rest...), nil
+	}
+
+	cmds, err := u.UniversalClient.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i := 1; i < n; i++ {
+			if left {
+				p.LPop(ctx, key)
+			} else {
+				p.RPop(ctx, key)
+			}
+		}
+
+		return nil
+	})
+	if err != nil && !IsNil(err) {
+		// item already popped, return it anyway
+		u.logger.Error("pop rest items", zap.String("key", key), zap.Error(err))
 	}
 
-	if length >= 100 {
-		if err = u.Client.LTrim(ctx, key, -10, -1).Err(); err != nil {
-			u.logger.Error("trim", zap.String("key", key), zap.Error(err))
+	for _, cmd := range cmds {
+		if v, err := cmd.(*redis.StringCmd).Result(); err == nil {
+			vals = append(vals, v)
 		}
+	}
+
+	return key, vals, nil
+}
 
-		u.logger.Info("trim array", zap.String("key", key))
+// RPush rpush keys and truncate its length
+//
+// keep the newest 100 items, use `NewCappedList` to customize.
+func (u *Utils) RPush(ctx context.Context, key string, payloads ...interface{}) (err error) {
+	l, err := u.NewCappedList(key)
+	if err != nil {
+		return err
 	}
 
-	return u.Client.RPush(ctx, key, payloads...).Err()
+	_, err = l.Push(ctx, payloads...)
+	return err
 }
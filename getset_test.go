@@ -2,6 +2,8 @@ package redis
 
 import (
 	"context"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -123,3 +125,247 @@ func TestUtils_GetItemBlockingWithDelete(t *testing.T) {
 	require.True(t, IsNil(err))
 	require.Equal(t, "", data)
 }
+
+func TestUtils_GetItemBlockingKeyspaceNotify(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dbkey := "/TestUtils_GetItemBlockingKeyspaceNotify/" + gutils.RandomStringWithLength(10)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(200 * time.Millisecond)
+
+		// writer should not be affected by test's ctx
+		ctxWrite, cancelWrite := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelWrite()
+		if err := rdb.Set(ctxWrite, dbkey, "val", KeyExpImmortal).Err(); err != nil {
+			t.Errorf("set: %v", err)
+		}
+	}()
+
+	// falls back to polling if keyspace notifications are not available
+	data, err := rtils.GetItemBlocking(ctx, dbkey,
+		rtils.WithGetItemBlockingKeyspaceNotify(true),
+		rtils.WithGetItemBlockingEnableKeyspaceNotify(true),
+		rtils.WithGetItemBlockingNotifyFallbackInterval(100*time.Millisecond),
+		rtils.WithGetItemBlockingPollInterval(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "val", data)
+
+	_, err = rdb.Get(ctx, dbkey).Result()
+	require.True(t, IsNil(err))
+
+	subs, err := rtils.keyspaceSubscriptions(ctx, dbkey)
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "__keyspace@0__:"+dbkey, subs[0].channel)
+
+	// disabled
+	opt := &getItemBlockingOption{}
+	require.NoError(t, rtils.WithGetItemBlockingKeyspaceNotify(true)(opt))
+	require.NoError(t, rtils.WithGetItemBlockingKeyspaceNotify(false)(opt))
+	require.False(t, opt.keyspaceNotify)
+}
+
+func TestUtils_GetItemBlockingKeyspaceNotify_ring(t *testing.T) {
+	rdb := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"a": "127.0.0.1:6379", "b": "127.0.0.1:6379"},
+		NewClient: func(name string, opt *redis.Options) *redis.Client {
+			// shards on different db
+			opt.DB = map[string]int{"a": 4, "b": 5}[name]
+			return redis.NewClient(opt)
+		},
+	})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dbkey := "/TestUtils_GetItemBlockingKeyspaceNotify_ring/" + gutils.RandomStringWithLength(10)
+
+	// subscribe every shard with its own db
+	subs, err := rtils.keyspaceSubscriptions(ctx, dbkey)
+	require.NoError(t, err)
+	var channels []string
+	for _, sub := range subs {
+		channels = append(channels, sub.channel)
+	}
+	require.ElementsMatch(t, []string{
+		"__keyspace@4__:" + dbkey,
+		"__keyspace@5__:" + dbkey,
+	}, channels)
+
+	// woken up by notification from any shard
+	waiter := &lockWaiter{
+		rdb:              rtils,
+		logger:           rtils.logger,
+		channel:          keyspaceChannel(0, dbkey),
+		subscriptions:    subs,
+		fallbackInterval: time.Minute,
+	}
+	defer waiter.close()
+	waiter.wait(ctx) // subscribe
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = subs[1].client.Publish(ctx, subs[1].channel, "set").Err()
+	}()
+	start := time.Now()
+	waiter.wait(ctx)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(200 * time.Millisecond)
+
+		ctxWrite, cancelWrite := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelWrite()
+		if err := rdb.Set(ctxWrite, dbkey, "val", KeyExpImmortal).Err(); err != nil {
+			t.Errorf("set: %v", err)
+		}
+	}()
+
+	// falls back to polling by poll interval if keyspace notifications are not available
+	start = time.Now()
+	data, err := rtils.GetItemBlocking(ctx, dbkey,
+		rtils.WithGetItemBlockingKeyspaceNotify(true),
+		rtils.WithGetItemBlockingPollInterval(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "val", data)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestUtils_PopKeysBlockingN(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key1 := gutils.RandomStringWithLength(20)
+	key2 := gutils.RandomStringWithLength(20)
+	require.NoError(t, rdb.RPush(ctx, key2, "a", "b", "c").Err())
+
+	key, vals, err := rtils.LPopKeysBlockingN(ctx, 2, key1, key2)
+	require.NoError(t, err)
+	require.Equal(t, key2, key)
+	require.Equal(t, []string{"a", "b"}, vals)
+
+	key, val, err := rtils.RPopKeysBlocking(ctx, key1, key2)
+	require.NoError(t, err)
+	require.Equal(t, key2, key)
+	require.Equal(t, "c", val)
+
+	// wake up once pushed
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = rdb.RPush(ctx, key1, "d", "e").Err()
+	}()
+	key, vals, err = rtils.RPopKeysBlockingN(ctx, 5, key1, key2)
+	require.NoError(t, err)
+	require.Equal(t, key1, key)
+	require.Equal(t, []string{"e", "d"}, vals)
+
+	// honor ctx
+	ctxTimeout, cancelTimeout := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancelTimeout()
+	start := time.Now()
+	_, _, err = rtils.LPopKeysBlocking(ctxTimeout, key1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestUtils_ScanItems(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prefix := "/TestUtils_ScanItems/" + gutils.RandomStringWithLength(10) + "/"
+	for i := 0; i < 25; i++ {
+		require.NoError(t, rdb.Set(ctx, prefix+strconv.Itoa(i), i, KeyExpImmortal).Err())
+	}
+	require.NoError(t, rdb.RPush(ctx, prefix+"list", "a").Err())
+
+	iter, err := rtils.ScanItems(prefix+"*",
+		rtils.WithScanItemsCount(5),
+		rtils.WithScanItemsBatchSize(7),
+	)
+	require.NoError(t, err)
+
+	items := map[string]string{}
+	for iter.Next(ctx) {
+		items[iter.Key()] = iter.Val()
+	}
+	require.NoError(t, iter.Err())
+	require.Len(t, items, 25)
+	require.Equal(t, "3", items[prefix+"3"])
+
+	// glob
+	iter, err = rtils.ScanItems(prefix + "1?")
+	require.NoError(t, err)
+	var n int
+	for iter.Next(ctx) {
+		n++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, 10, n)
+
+	// non-string keys
+	all, err := rtils.GetItemWithPrefix(ctx, prefix)
+	require.NoError(t, err)
+	require.Len(t, all, 25)
+
+	// type filter is ignored if server does not support it
+	iter, err = rtils.ScanItems(prefix+"*", rtils.WithScanItemsType("string"))
+	require.NoError(t, err)
+	n = 0
+	for iter.Next(ctx) {
+		n++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, 25, n)
+}
+
+func TestUtils_ScanItems_ring(t *testing.T) {
+	rdb := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"a": "127.0.0.1:6379", "b": "127.0.0.1:6379"},
+		NewClient: func(name string, opt *redis.Options) *redis.Client {
+			// shards on different db
+			opt.DB = map[string]int{"a": 4, "b": 5}[name]
+			return redis.NewClient(opt)
+		},
+	})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prefix := "/TestUtils_ScanItems_ring/" + gutils.RandomStringWithLength(10) + "/"
+	for i := 0; i < 25; i++ {
+		require.NoError(t, rdb.Set(ctx, prefix+strconv.Itoa(i), i, KeyExpImmortal).Err())
+	}
+	require.NoError(t, rdb.RPush(ctx, prefix+"list", "a").Err())
+
+	iter, err := rtils.ScanItems(prefix+"*", rtils.WithScanItemsBatchSize(7))
+	require.NoError(t, err)
+
+	items := map[string]string{}
+	for iter.Next(ctx) {
+		items[iter.Key()] = iter.Val()
+	}
+	require.NoError(t, iter.Err())
+	require.Len(t, items, 25)
+	require.Equal(t, "3", items[prefix+"3"])
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+)
+
+// lockLease lifetime of one acquisition
+//
+// lease is ended either by heartbeat when lock is lost,
+// or by unlock, the first reason is reported to `onLost`.
+type lockLease struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	onLost func(reason error)
+	once   sync.Once
+}
+
+func newLockLease(ctx context.Context, onLost func(reason error)) *lockLease {
+	l := &lockLease{onLost: onLost}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	return l
+}
+
+// end cancel lease's context, report reason only once
+func (l *lockLease) end(reason error) {
+	l.once.Do(func() {
+		l.cancel()
+		if l.onLost != nil {
+			l.onLost(reason)
+		}
+	})
+}
+
+// stop cancel lease's context without reporting,
+// used when lease is replaced by a new one
+func (l *lockLease) stop() {
+	l.once.Do(l.cancel)
+}
+
+// keepAlive refresh lock every heartbeat interval until lease is ended.
+//
+// failed refreshing is retried every `refreshRetryInterval`,
+// until lock's ttl (minus `refreshGrace`) since the last succeeded refreshing is passed,
+// then lease is ended with ErrLockUnreachable.
+// if lock is not held anymore, lease is ended with the error returned by notHeld.
+func keepAlive(lease *lockLease, opt *mutexOption, logger gutils.LoggerItf,
+	extend func(ctx context.Context) (bool, error),
+	notHeld func(ctx context.Context) error) {
+	keepAliveUntil(lease, opt, time.Now().Add(opt.ttl-opt.refreshGrace), logger, extend, notHeld)
+}
+
+// keepAliveUntil same as keepAlive, but lock is considered lost at deadline
+// if the first refreshing is not succeed before it
+func keepAliveUntil(lease *lockLease, opt *mutexOption, deadline time.Time, logger gutils.LoggerItf,
+	extend func(ctx context.Context) (bool, error),
+	notHeld func(ctx context.Context) error) {
+	timer := time.NewTimer(opt.heartbeatInterval)
+	defer timer.Stop()
+	defer logger.Debug("stop refreshing lock")
+
+	for {
+		select {
+		case <-lease.ctx.Done():
+			lease.end(lease.ctx.Err())
+			return
+		case <-timer.C:
+		}
+
+		start := time.Now()
+		ctx, cancel := context.WithDeadline(lease.ctx, deadline)
+		ok, err := extend(ctx)
+		cancel()
+		switch {
+		case err == nil && ok:
+			logger.Debug("succeed renew lock")
+			deadline = start.Add(opt.ttl - opt.refreshGrace)
+			timer.Reset(opt.heartbeatInterval)
+		case err == nil:
+			reason := notHeld(lease.ctx)
+			logger.Warn("lock lost", zap.Error(reason))
+			lease.end(reason)
+			return
+		case lease.ctx.Err() != nil:
+			timer.Reset(0)
+		case !time.Now().Add(opt.refreshRetryInterval).Before(deadline):
+			reason := fmt.Errorf("%w: %s", ErrLockUnreachable, err.Error())
+			logger.Warn("lock lost", zap.Error(reason))
+			lease.end(reason)
+			return
+		default:
+			logger.Warn("renew lock, retry", zap.Error(err))
+			timer.Reset(opt.refreshRetryInterval)
+		}
+	}
+}
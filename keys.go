@@ -1,42 +1,129 @@
 package redis
 
 const (
-	// DefaultKeyPrefix default prefix of key in redis
+	// DefaultKeyPrefix default prefix of key in redis,
+	// could be changed by `WithUtilsKeyPrefix`
 	DefaultKeyPrefix = "/rtils/"
 )
 
+// keys below are relative to key prefix, built by `Utils.buildKey`,
+// comments show the full keys with default prefix.
+
+// all key families wrap the user-provided name in a hash tag `{<name>}`,
+// so every key belongs to the same primitive will be hashed into the same slot,
+// then multi-key commands (pipeline, `ZINTERSTORE`, lua scripts)
+// could work on redis cluster.
+
 // rank
 const (
 	// defaultKeyRank default key prefix of score rank
-	//   `/rtils/sync/rank/<rank_name>`
-	defaultKeyRank = DefaultKeyPrefix + "rank/%s/"
+	//   `/rtils/rank/{<rank_name>}/`
+	defaultKeyRank = "rank/{%s}/"
 
 	// defaultKeyRankMeta meta data
-	//   `/rtils/sync/rank/<rank_name>/meta`
+	//   `/rtils/rank/{<rank_name>}/meta`
 	// defaultKeyRankMeta = defaultKeyRank + "meta"
 	// defaultKeyRankData ranking list
-	//   `/rtils/sync/rank/<rank_name>/data/`
+	//   `/rtils/rank/{<rank_name>}/data/`
 	defaultKeyRankData = defaultKeyRank + "data/"
 )
 
+// queue
+const (
+	// defaultKeyQueue default key prefix of reliable queue
+	//   `/rtils/queue/{<queue_name>}/`
+	defaultKeyQueue = "queue/{%s}/"
+	// defaultKeyQueueReady messages waiting for delivery
+	//   `/rtils/queue/{<queue_name>}/ready`
+	defaultKeyQueueReady = defaultKeyQueue + "ready"
+	// defaultKeyQueueProcessing messages delivered to consumer but not acked
+	//   `/rtils/queue/{<queue_name>}/processing/<consumer_id>`
+	defaultKeyQueueProcessing = defaultKeyQueue + "processing/%s"
+	// defaultKeyQueueDeadlines visibility deadline of processing messages
+	//   `/rtils/queue/{<queue_name>}/deadlines`
+	defaultKeyQueueDeadlines = defaultKeyQueue + "deadlines"
+	// defaultKeyQueueConsumers alive deadline of consumers who may have processing messages
+	//   `/rtils/queue/{<queue_name>}/consumers`
+	defaultKeyQueueConsumers = defaultKeyQueue + "consumers"
+	// defaultKeyQueueDead dead-letter messages exceeded retry limit
+	//   `/rtils/queue/{<queue_name>}/dead`
+	defaultKeyQueueDead = defaultKeyQueue + "dead"
+)
+
+// near cache
+const (
+	// defaultKeyNearCacheInvalidate pub/sub channel to notify local copies are stale
+	//   `/rtils/nearcache/{<cache_name>}/invalidate`
+	defaultKeyNearCacheInvalidate = "nearcache/{%s}/invalidate"
+)
+
 // sync
 const (
 	// defaultKeySync default key prefix of sync
-	defaultKeySync = DefaultKeyPrefix + "sync/"
+	defaultKeySync = "sync/"
 	// defaultKeySyncMutex default key prefix of sync mutex
-	//   `/rtils/sync/mutex/<lock_name>`
-	defaultKeySyncMutex = defaultKeySync + "mutex/%s"
+	//   `/rtils/sync/mutex/{<lock_name>}`
+	defaultKeySyncMutex = defaultKeySync + "mutex/{%s}"
+	// defaultKeySyncMutexRelease pub/sub channel to notify lock released
+	//   `/rtils/sync/mutex/{<lock_name>}/release`
+	defaultKeySyncMutexRelease = defaultKeySyncMutex + "/release"
+	// defaultKeySyncMutexFence fencing token counter of mutex, never expires
+	//   `/rtils/sync/mutex/{<lock_name>}/fence`
+	defaultKeySyncMutexFence = defaultKeySyncMutex + "/fence"
+
+	// defaultKeySyncElectionLeader leader's metadata, next to the lock key of election
+	//   `/rtils/sync/mutex/{<election_name>}/leader`
+	defaultKeySyncElectionLeader = defaultKeySyncMutex + "/leader"
+	// defaultKeySyncElectionChanged pub/sub channel to notify leader changed
+	//   `/rtils/sync/mutex/{<election_name>}/leader/changed`
+	defaultKeySyncElectionChanged = defaultKeySyncElectionLeader + "/changed"
+
+	// defaultKeySyncRWMutex default key prefix of sync rwmutex
+	//   `/rtils/sync/rwmutex/{<lock_name>}`
+	defaultKeySyncRWMutex = defaultKeySync + "rwmutex/{%s}"
+	// defaultKeySyncRWMutexWriter writer who holds the write lock, hash of owner & count
+	//   `/rtils/sync/rwmutex/{<lock_name>}/writer`
+	defaultKeySyncRWMutexWriter = defaultKeySyncRWMutex + "/writer"
+	// defaultKeySyncRWMutexReaders all readers who hold the read lock
+	//   `/rtils/sync/rwmutex/{<lock_name>}/readers`
+	defaultKeySyncRWMutexReaders = defaultKeySyncRWMutex + "/readers"
+	// defaultKeySyncRWMutexReaderCounts reentrant count of each reader
+	//   `/rtils/sync/rwmutex/{<lock_name>}/readers/count`
+	defaultKeySyncRWMutexReaderCounts = defaultKeySyncRWMutexReaders + "/count"
+	// defaultKeySyncRWMutexPending writer who is waiting for the write lock
+	//   `/rtils/sync/rwmutex/{<lock_name>}/pending`
+	defaultKeySyncRWMutexPending = defaultKeySyncRWMutex + "/pending"
+	// defaultKeySyncRWMutexRelease pub/sub channel to notify lock released
+	//   `/rtils/sync/rwmutex/{<lock_name>}/release`
+	defaultKeySyncRWMutexRelease = defaultKeySyncRWMutex + "/release"
 
 	// defaultKeySyncSemaphore default key prefix of sync semaphore
-	//   `/rtils/sync/sema/<lock_name>`
-	defaultKeySyncSemaphore = defaultKeySync + "sema/%s"
+	//   `/rtils/sync/sema/{<lock_name>}`
+	defaultKeySyncSemaphore = defaultKeySync + "sema/{%s}"
 	// defaultKeySyncSemaphoreLocks all semaphore locks
-	//   `/rtils/sync/sema/<lock_name>/ids/`
+	//   `/rtils/sync/sema/{<lock_name>}/ids/`
 	defaultKeySyncSemaphoreLocks = defaultKeySyncSemaphore + "/ids/"
 	// defaultKeySyncSemaphoreOwners default key prefix of sync semaphore
-	//   `/rtils/sync/sema/<lock_name>/owners/`
+	//   `/rtils/sync/sema/{<lock_name>}/owners/`
 	defaultKeySyncSemaphoreOwners = defaultKeySyncSemaphore + "/owners/"
 	// defaultKeySyncSemaphoreCounter default key prefix of sync semaphore
-	//   `/rtils/sync/sema/<lock_name>/counter`
+	//   `/rtils/sync/sema/{<lock_name>}/counter`
 	defaultKeySyncSemaphoreCounter = defaultKeySyncSemaphore + "/counter"
+	// defaultKeySyncSemaphoreRelease pub/sub channel to notify lock released
+	//   `/rtils/sync/sema/{<lock_name>}/release`
+	defaultKeySyncSemaphoreRelease = defaultKeySyncSemaphore + "/release"
+
+	// defaultKeySyncRateLimiter default key prefix of rate limiter
+	//   `/rtils/sync/ratelimit/{<limiter_name>}/<algorithm>`
+	defaultKeySyncRateLimiter = defaultKeySync + "ratelimit/{%s}/%s"
+
+	// defaultKeySyncScheduler default key prefix of scheduler
+	//   `/rtils/sync/scheduler/{<scheduler_name>}`
+	defaultKeySyncScheduler = defaultKeySync + "scheduler/{%s}"
+	// defaultKeySyncSchedulerJob status of job
+	//   `/rtils/sync/scheduler/{<scheduler_name>}/jobs/<job_name>`
+	defaultKeySyncSchedulerJob = defaultKeySyncScheduler + "/jobs/%s"
+	// defaultKeySyncSchedulerTick lock of one tick of job
+	//   `/rtils/sync/scheduler/{<scheduler_name>}/jobs/<job_name>/ticks/<unix_ms>`
+	defaultKeySyncSchedulerTick = defaultKeySyncSchedulerJob + "/ticks/%d"
 )
@@ -0,0 +1,134 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LockHandle one acquisition of a lock, returned by `Acquire`
+//
+// each handle owns a unique client id derived from the lock's client id,
+// so handles acquired from the same Mutex/Semaphore exclude each other
+// and are not reentrant.
+// all methods are safe for concurrent use.
+type LockHandle interface {
+	// Ctx context of this acquisition,
+	// will be set to done when lock is expired, taken over, or released by Unlock.
+	//
+	// fencing token of mutex could be loaded by `FencingToken`
+	Ctx() context.Context
+	// Unlock release this acquisition
+	//
+	// return ErrLockReleased if already unlocked,
+	// ErrLockNotHeld if lock is expired, or `*ErrLockLost` if taken over by another client.
+	Unlock(ctx context.Context) error
+	// Extend reset lock's ttl immediately
+	//
+	// return ErrLockNotHeld if lock is not held by this handle anymore.
+	Extend(ctx context.Context) error
+	// TTL remaining ttl of lock
+	//
+	// return ErrLockNotHeld if lock is not held by this handle anymore.
+	TTL(ctx context.Context) (time.Duration, error)
+}
+
+// newHandleClientID unique client id of a lock handle
+func newHandleClientID(clientID string) string {
+	return clientID + "/" + uuid.New().String()
+}
+
+// lockHandle lock handle backed by operations bound to handle's client id
+type lockHandle struct {
+	cid     string
+	ctx     context.Context
+	lease   *lockLease
+	extend  func(ctx context.Context) (ok bool, err error)
+	release func(ctx context.Context) (ok bool, err error)
+	ttl     func(ctx context.Context) (ttl time.Duration, ok bool, err error)
+	// notHeld error when lock is not held by this handle,
+	// ErrLockNotHeld if nil
+	notHeld func(ctx context.Context) error
+
+	mu       sync.Mutex
+	released bool
+}
+
+// Ctx context of this acquisition
+func (h *lockHandle) Ctx() context.Context {
+	return h.ctx
+}
+
+// Unlock release this acquisition
+func (h *lockHandle) Unlock(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return ErrLockReleased
+	}
+
+	ok, err := h.release(ctx)
+	if err != nil {
+		return err // heartbeat keeps running, caller could retry
+	}
+
+	h.released = true
+	if !ok {
+		err = h.notHeldErr(ctx)
+		h.lease.end(err)
+		return err
+	}
+
+	h.lease.end(ErrLockReleased)
+	return nil
+}
+
+// Extend reset lock's ttl immediately
+func (h *lockHandle) Extend(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return ErrLockReleased
+	}
+
+	ok, err := h.extend(ctx)
+	if err != nil {
+		return err
+	} else if !ok {
+		err = h.notHeldErr(ctx)
+		h.lease.end(err)
+		return err
+	}
+
+	return nil
+}
+
+// TTL remaining ttl of lock
+func (h *lockHandle) TTL(ctx context.Context) (time.Duration, error) {
+	h.mu.Lock()
+	released := h.released
+	h.mu.Unlock()
+	if released {
+		return 0, ErrLockReleased
+	}
+
+	ttl, ok, err := h.ttl(ctx)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, h.notHeldErr(ctx)
+	}
+
+	return ttl, nil
+}
+
+// notHeldErr error when lock is not held by this handle
+func (h *lockHandle) notHeldErr(ctx context.Context) error {
+	if h.notHeld == nil {
+		return ErrLockNotHeld
+	}
+
+	return h.notHeld(ctx)
+}
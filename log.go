@@ -2,14 +2,18 @@ package redis
 
 import (
 	"sync"
+	"sync/atomic"
 
 	gutils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
+	"github.com/Laisky/zap/zapcore"
 )
 
 var (
 	logMux sync.RWMutex
 	logger gutils.LoggerItf
+	// logGen increased every time logger is replaced by `SetLogger`
+	logGen uint64
 )
 
 func init() {
@@ -23,5 +27,93 @@ func init() {
 func SetLogger(log gutils.LoggerItf) {
 	logMux.Lock()
 	logger = log
+	logGen++
 	logMux.Unlock()
 }
+
+// getLogger get go-redis logger set by `SetLogger`
+func getLogger() gutils.LoggerItf {
+	logMux.RLock()
+	defer logMux.RUnlock()
+	return logger
+}
+
+// getLoggerGen get go-redis logger and its generation
+func getLoggerGen() (gutils.LoggerItf, uint64) {
+	logMux.RLock()
+	defer logMux.RUnlock()
+	return logger, logGen
+}
+
+// globalLogger resolve go-redis logger on every call,
+// so `SetLogger` takes effect on existing instances.
+//
+// derived loggers by `With`/`Named`/`WithOptions` are resolved lazily as well,
+// and cached until logger is replaced.
+type globalLogger struct {
+	derives []func(gutils.LoggerItf) gutils.LoggerItf
+	// cache *cachedLogger
+	cache atomic.Value
+}
+
+// cachedLogger logger derived from the generation gen of go-redis logger
+type cachedLogger struct {
+	gen    uint64
+	logger gutils.LoggerItf
+}
+
+func (l *globalLogger) get() gutils.LoggerItf {
+	base, gen := getLoggerGen()
+	if cached, ok := l.cache.Load().(*cachedLogger); ok && cached.gen == gen {
+		return cached.logger
+	}
+
+	// skip methods of globalLogger
+	lg := base.WithOptions(zap.AddCallerSkip(1))
+	for _, derive := range l.derives {
+		lg = derive(lg)
+	}
+
+	l.cache.Store(&cachedLogger{gen: gen, logger: lg})
+	return lg
+}
+
+func (l *globalLogger) derive(fn func(gutils.LoggerItf) gutils.LoggerItf) gutils.LoggerItf {
+	derives := make([]func(gutils.LoggerItf) gutils.LoggerItf, 0, len(l.derives)+1)
+	return &globalLogger{derives: append(append(derives, l.derives...), fn)}
+}
+
+func (l *globalLogger) Debug(msg string, fields ...zapcore.Field) { l.get().Debug(msg, fields...) }
+func (l *globalLogger) Info(msg string, fields ...zapcore.Field)  { l.get().Info(msg, fields...) }
+func (l *globalLogger) Warn(msg string, fields ...zapcore.Field)  { l.get().Warn(msg, fields...) }
+func (l *globalLogger) Error(msg string, fields ...zapcore.Field) { l.get().Error(msg, fields...) }
+func (l *globalLogger) DPanic(msg string, fields ...zapcore.Field) {
+	l.get().DPanic(msg, fields...)
+}
+func (l *globalLogger) Panic(msg string, fields ...zapcore.Field) { l.get().Panic(msg, fields...) }
+func (l *globalLogger) Fatal(msg string, fields ...zapcore.Field) { l.get().Fatal(msg, fields...) }
+func (l *globalLogger) Sync() error                               { return l.get().Sync() }
+func (l *globalLogger) Core() zapcore.Core                        { return l.get().Core() }
+func (l *globalLogger) Level() zapcore.Level                      { return l.get().Level() }
+func (l *globalLogger) ChangeLevel(level string) error            { return l.get().ChangeLevel(level) }
+func (l *globalLogger) DebugSample(sample int, msg string, fields ...zapcore.Field) {
+	l.get().DebugSample(sample, msg, fields...)
+}
+func (l *globalLogger) InfoSample(sample int, msg string, fields ...zapcore.Field) {
+	l.get().InfoSample(sample, msg, fields...)
+}
+func (l *globalLogger) WarnSample(sample int, msg string, fields ...zapcore.Field) {
+	l.get().WarnSample(sample, msg, fields...)
+}
+func (l *globalLogger) Clone() gutils.LoggerItf {
+	return l.derive(func(lg gutils.LoggerItf) gutils.LoggerItf { return lg })
+}
+func (l *globalLogger) Named(s string) gutils.LoggerItf {
+	return l.derive(func(lg gutils.LoggerItf) gutils.LoggerItf { return lg.Named(s) })
+}
+func (l *globalLogger) With(fields ...zapcore.Field) gutils.LoggerItf {
+	return l.derive(func(lg gutils.LoggerItf) gutils.LoggerItf { return lg.With(fields...) })
+}
+func (l *globalLogger) WithOptions(opts ...zap.Option) gutils.LoggerItf {
+	return l.derive(func(lg gutils.LoggerItf) gutils.LoggerItf { return lg.WithOptions(opts...) })
+}
@@ -2,7 +2,7 @@ package redis
 
 import (
 	"context"
-	"fmt"
+	"sync"
 	"time"
 
 	gutils "github.com/Laisky/go-utils"
@@ -17,6 +17,9 @@ const (
 	defaultMutexTTL               = 3 * time.Second
 	defaultSpinInterval           = 100 * time.Millisecond
 	defaultBlocking               = true
+	defaultReleaseNotify          = true
+	defaultNotifyFallbackInterval = time.Second
+	defaultRefreshRetryInterval   = 100 * time.Millisecond
 )
 
 type mutexOption struct {
@@ -25,48 +28,266 @@ type mutexOption struct {
 	spinInterval      time.Duration
 	blocking          bool
 	clientID          string
+	// releaseNotify whether to subscribe release notification when blocking
+	releaseNotify bool
+	// notifyFallbackInterval retry interval when subscribed release notification
+	notifyFallbackInterval time.Duration
+	// refreshRetryInterval retry interval when failed to refresh lock
+	refreshRetryInterval time.Duration
+	// refreshGrace lock is considered lost `refreshGrace` before ttl deadline
+	refreshGrace time.Duration
+	// onLost called once lock is ended
+	onLost func(reason error)
 }
 
-func newMutexOption() *mutexOption {
+// newMutexOption default options of locks,
+// ttl could be changed by `WithUtilsLockTTL`
+func (u *Utils) newMutexOption() *mutexOption {
+	ttl, heartbeat := defaultMutexTTL, defaultMutexHeartbeatInterval
+	if u.lockTTL != 0 {
+		ttl, heartbeat = u.lockTTL, u.lockTTL/3
+	}
+
 	return &mutexOption{
-		ttl:               defaultMutexTTL,
-		heartbeatInterval: defaultMutexHeartbeatInterval,
+		ttl:               ttl,
+		heartbeatInterval: heartbeat,
 		spinInterval:      defaultSpinInterval,
 		blocking:          defaultBlocking,
 		clientID:          uuid.New().String(),
+
+		releaseNotify:          defaultReleaseNotify,
+		notifyFallbackInterval: defaultNotifyFallbackInterval,
+		refreshRetryInterval:   defaultRefreshRetryInterval,
 	}
 }
 
+// validate check options after all of them are applied
+func (o *mutexOption) validate() error {
+	if o.refreshGrace >= o.ttl {
+		return errors.Wrapf(ErrInvalidArgument,
+			"refresh grace `%s` must less than ttl `%s`", o.refreshGrace, o.ttl)
+	}
+
+	return nil
+}
+
+// mutexLockScript acquire or reenter lock
+//
+// KEYS[1]: lock key, hash of owner & count
+// KEYS[2]: fencing token counter
+// ARGV[1]: client id
+// ARGV[2]: ttl in milliseconds
+//
+// return {fencing token, reentrant count} if acquired,
+// {0, 0} if lock is held by another client.
+// new acquisition increases the token, reentrant acquisition reuses the current token.
+var mutexLockScript = redis.NewScript(`
+local owner = redis.call("HGET", KEYS[1], "owner")
+if not owner then
+	redis.call("HSET", KEYS[1], "owner", ARGV[1], "count", 1)
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return {redis.call("INCR", KEYS[2]), 1}
+end
+if owner == ARGV[1] then
+	local count = redis.call("HINCRBY", KEYS[1], "count", 1)
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	local token = redis.call("GET", KEYS[2])
+	if not token then
+		return {redis.call("INCR", KEYS[2]), count}
+	end
+	return {tonumber(token), count}
+end
+return {0, 0}
+`)
+
+// mutexRefreshScript compare-and-expire
+//
+// KEYS[1]: lock key, hash of owner & count
+// ARGV[1]: client id
+// ARGV[2]: ttl in milliseconds
+//
+// return 1 if refreshed, 0 if lock is not held by this client
+var mutexRefreshScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "owner") == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// mutexTTLScript remaining ttl if lock is held by this client
+//
+// KEYS[1]: lock key, hash of owner & count
+// ARGV[1]: client id
+//
+// return ttl in milliseconds, -1 if lock is not held by this client
+var mutexTTLScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "owner") ~= ARGV[1] then
+	return -1
+end
+return redis.call("PTTL", KEYS[1])
+`)
+
+// mutexUnlockScript decrease reentrant count,
+// delete lock and notify waiters if count reaches zero
+//
+// KEYS[1]: lock key, hash of owner & count
+// ARGV[1]: client id
+// ARGV[2]: release channel
+//
+// return remaining reentrant count, 0 if released,
+// -1 if lock is not held by this client
+var mutexUnlockScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "owner") ~= ARGV[1] then
+	return -1
+end
+
+local count = redis.call("HINCRBY", KEYS[1], "count", -1)
+if count > 0 then
+	return count
+end
+
+redis.call("DEL", KEYS[1])
+redis.call("PUBLISH", ARGV[2], ARGV[1])
+return 0
+`)
+
 // mutexType distributed mutex
 //
 // Redis keys:
 //
-//	`/rtils/sync/mutex/<lock_id>/<client_id>`
+//	`/rtils/sync/mutex/{<lock_id>}`: hash of owner(client_id) & count(reentrant count)
+//	`/rtils/sync/mutex/{<lock_id>}/fence`: fencing token counter
 //
 // Implementations:
 //
+// all operations are atomic lua scripts, invoked by `EVALSHA`
+// (fallback to `EVAL` if script not loaded).
+//
 //  1. generate client id(cid)
-//  2. set if not exists by `SETNX` with ttl: lock_name -> cid
-//  3. if succeeded set, auto refresh lock's ttl
+//  2. lock: set if not exists with ttl: lock_name -> {owner: cid, count: 1},
+//     and increase fencing token,
+//     or increase count and refresh ttl if owner is cid (reentrant)
+//  3. if succeeded set, auto refresh lock's ttl by compare-and-expire
+//  4. unlock: decrease count if owner is cid,
+//     delete lock and publish to release channel if count reaches zero
+//  5. blocking waiters subscribe release channel, retry once notified,
+//     or spin as fallback if notification is lost
 type Mutex interface {
 	// Lock acquire a recursive lock
 	//
 	// if succeed acquired lock,
 	//   * locked == true
-	//   * lockCtx is context of lock, this context will be set to done when lock is expired
+	//   * lockCtx is context of lock, this context will be set to done when lock is expired,
+	//     or released by the matching Unlock
+	//   * fencing token could be loaded from lockCtx by `FencingToken`
+	//
+	// return locked == false with ErrLockTaken if lock is held by others and not blocking.
 	Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error)
 	// Unlock release lock
+	//
+	// each Lock should be paired with an Unlock,
+	// lock will be released after the outermost Unlock.
+	// return ErrLockNotHeld if lock is expired,
+	// or `*ErrLockLost` if lock is taken over by another client.
 	Unlock(ctx context.Context) error
+	// Acquire acquire a new non-reentrant lock, return its handle
+	//
+	// unlike Lock, each acquisition gets its own handle,
+	// so one Mutex could be shared by multiple goroutines.
+	// return ErrLockTaken if lock is held by others and not blocking.
+	Acquire(ctx context.Context) (LockHandle, error)
+}
+
+type fencingTokenCtxKey struct{}
+
+// FencingToken get fencing token from lockCtx returned by `Mutex.Lock`
+//
+// token increases on every new acquisition of the same lock,
+// reentrant acquisitions get the same token.
+// downstream storage could reject writes with a token smaller than
+// the largest one it has seen, to protect against stale lock holders.
+func FencingToken(lockCtx context.Context) (token int64, ok bool) {
+	token, ok = lockCtx.Value(fencingTokenCtxKey{}).(int64)
+	return token, ok
+}
+
+// lockCtxs lock contexts of a reentrant lock
+//
+// the outermost acquisition creates the root lease, which is refreshed by heartbeat,
+// and will be ended when lock is lost or finally released.
+// each reentrant acquisition derives a nested context from root,
+// nested context will be set to done by the matching unlock.
+type lockCtxs struct {
+	mu     sync.Mutex
+	root   *lockLease
+	nested []context.CancelFunc
+}
+
+// acquired register a succeeded acquisition with reentrant count,
+// return lease if a new root lease is created,
+// caller should start heartbeat for it.
+func (l *lockCtxs) acquired(ctx context.Context, count int64,
+	onLost func(reason error)) (lockCtx context.Context, lease *lockLease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if count > 1 && l.root != nil && l.root.ctx.Err() == nil {
+		lockCtx, cancel := context.WithCancel(l.root.ctx)
+		l.nested = append(l.nested, cancel)
+		return lockCtx, nil
+	}
+
+	l.reset()
+	l.root = newLockLease(ctx, onLost)
+	return l.root.ctx, l.root
+}
+
+// released register a succeeded release with remaining reentrant count
+func (l *lockCtxs) released(remaining int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if remaining > 0 {
+		if n := len(l.nested); n > 0 {
+			l.nested[n-1]()
+			l.nested = l.nested[:n-1]
+		}
+
+		return
+	}
+
+	l.reset()
+}
+
+// held whether lock is still held by root lease
+func (l *lockCtxs) held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.root != nil && l.root.ctx.Err() == nil
+}
+
+// reset end root lease, nested contexts are canceled as well
+func (l *lockCtxs) reset() {
+	if l.root != nil {
+		l.root.end(ErrLockReleased)
+	}
+
+	l.root, l.nested = nil, nil
 }
 
 type mutex struct {
 	*mutexOption
 	rdb    *Utils
 	logger gutils.LoggerItf
-	cancel context.CancelFunc
+	ctxs   lockCtxs
 
 	// name unique lock id
 	name string
+	// channel pub/sub channel to notify lock released
+	channel string
+	// fence fencing token counter
+	fence string
 }
 
 // MutexOptionFunc options for mutex
@@ -88,6 +309,24 @@ func WithMutexBlockingLock(blocking bool) MutexOptionFunc {
 	}
 }
 
+// WithMutexReleaseNotify set whether to subscribe release notification
+// when waiting for lock, otherwise spin every spin interval
+func WithMutexReleaseNotify(enable bool) MutexOptionFunc {
+	return func(mu *mutex) error {
+		mu.releaseNotify = enable
+		return nil
+	}
+}
+
+// WithMutexNotifyFallbackInterval set retry interval when subscribed release notification,
+// in case of notification is lost or lock is expired without release
+func WithMutexNotifyFallbackInterval(interval time.Duration) MutexOptionFunc {
+	return func(mu *mutex) error {
+		mu.notifyFallbackInterval = interval
+		return nil
+	}
+}
+
 // WithMutexRefreshInterval set lock refreshing interval
 func WithMutexRefreshInterval(interval time.Duration) MutexOptionFunc {
 	return func(mu *mutex) error {
@@ -104,6 +343,47 @@ func WithMutexTTL(ttl time.Duration) MutexOptionFunc {
 	}
 }
 
+// WithMutexRefreshRetryInterval set retry interval when failed to refresh lock,
+// lock keeps retrying until ttl deadline
+func WithMutexRefreshRetryInterval(interval time.Duration) MutexOptionFunc {
+	return func(mu *mutex) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "retry interval must greater than 0")
+		}
+
+		mu.refreshRetryInterval = interval
+		return nil
+	}
+}
+
+// WithMutexRefreshGrace consider lock as lost `grace` before ttl deadline
+// if failed to refresh lock, leave time for aborting jobs,
+// grace must less than ttl
+func WithMutexRefreshGrace(grace time.Duration) MutexOptionFunc {
+	return func(mu *mutex) error {
+		if grace < 0 {
+			return errors.Wrap(ErrInvalidArgument, "grace must not less than 0")
+		}
+
+		mu.refreshGrace = grace
+		return nil
+	}
+}
+
+// WithMutexOnLost set callback called once when lock is ended,
+// reason could be:
+//   - ErrLockReleased: released by unlock
+//   - ErrLockExpired: lock is expired
+//   - `*ErrLockLost`: lock is taken over by another client
+//   - ErrLockUnreachable: failed to refresh lock before ttl deadline
+//   - ctx.Err(): caller's ctx is done
+func WithMutexOnLost(onLost func(reason error)) MutexOptionFunc {
+	return func(mu *mutex) error {
+		mu.onLost = onLost
+		return nil
+	}
+}
+
 // WithMutexLogger set lock's expiration
 func WithMutexLogger(logger *gutils.LoggerType) MutexOptionFunc {
 	return func(mu *mutex) error {
@@ -125,8 +405,10 @@ func (u *Utils) NewMutex(lockName string, opts ...MutexOptionFunc) (Mutex, error
 	mu := &mutex{
 		logger:      u.logger,
 		rdb:         u,
-		name:        fmt.Sprintf(defaultKeySyncMutex, lockName),
-		mutexOption: newMutexOption(),
+		name:        u.buildKey(defaultKeySyncMutex, lockName),
+		channel:     u.buildKey(defaultKeySyncMutexRelease, lockName),
+		fence:       u.buildKey(defaultKeySyncMutexFence, lockName),
+		mutexOption: u.newMutexOption(),
 	}
 	for _, optf := range opts {
 		if err := optf(mu); err != nil {
@@ -134,107 +416,191 @@ func (u *Utils) NewMutex(lockName string, opts ...MutexOptionFunc) (Mutex, error
 		}
 	}
 
+	if err := mu.validate(); err != nil {
+		return nil, err
+	}
+
 	return mu, nil
 }
 
-func (m *mutex) refreshLock(ctx context.Context, cancel func()) {
-	defer cancel()
-	ticker := time.NewTicker(m.heartbeatInterval)
-	defer ticker.Stop()
-	defer m.logger.Debug("release key", zap.String("dbkey", m.name))
+// acquire try to acquire or reenter lock once,
+// return fencing token and reentrant count if acquired,
+// or 0 if lock is held by another client
+func (m *mutex) acquire(ctx context.Context, cid string) (token, count int64, err error) {
+	ret, err := mutexLockScript.Run(ctx, m.rdb,
+		[]string{m.name, m.fence}, cid, m.ttl.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "acquire lock `%s`", m.name)
+	}
+
+	return ret[0], ret[1], nil
+}
+
+// extend reset lock's ttl if lock is still held by this client
+func (m *mutex) extend(ctx context.Context, cid string) (ok bool, err error) {
+	if ok, err = mutexRefreshScript.Run(ctx, m.rdb,
+		[]string{m.name}, cid, m.ttl.Milliseconds()).Bool(); err != nil {
+		return false, errors.Wrapf(err, "renew lock `%s`", m.name)
+	}
+
+	return ok, nil
+}
+
+// release decrease reentrant count if lock is still held by this client,
+// return remaining count, 0 if lock is released, -1 if lock is not held
+func (m *mutex) release(ctx context.Context, cid string) (remaining int64, err error) {
+	if remaining, err = mutexUnlockScript.Run(ctx, m.rdb,
+		[]string{m.name}, cid, m.channel).Int64(); err != nil {
+		return 0, errors.Wrapf(err, "release lock `%s`", m.name)
+	}
+
+	return remaining, nil
+}
+
+// ttlOf remaining ttl of lock if lock is still held by this client
+func (m *mutex) ttlOf(ctx context.Context, cid string) (ttl time.Duration, ok bool, err error) {
+	ms, err := mutexTTLScript.Run(ctx, m.rdb, []string{m.name}, cid).Int64()
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "get ttl of lock `%s`", m.name)
+	} else if ms < 0 {
+		return 0, false, nil
+	}
+
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
+// notHeld error of lock not held by cid,
+// `*ErrLockLost` if lock is held by another client, ErrLockExpired if lock not exists
+func (m *mutex) notHeld(ctx context.Context, cid string) error {
+	owner, err := m.rdb.HGet(ctx, m.name, "owner").Result()
+	switch {
+	case IsNil(err):
+		return ErrLockExpired
+	case err != nil || owner == cid:
+		return ErrLockNotHeld
+	default:
+		return &ErrLockLost{Lock: m.name, Owner: owner}
+	}
+}
+
+// wait acquire lock by cid, block until acquired if blocking,
+// return 0 token if lock is held by others and not blocking
+func (m *mutex) wait(ctx context.Context, cid string) (token, count int64, err error) {
+	waiter := newLockWaiter(m.rdb, m.logger, m.channel, m.mutexOption)
+	defer waiter.close()
+
 	for {
 		select {
 		case <-ctx.Done():
-			return
-		case <-ticker.C:
+			return 0, 0, ctx.Err()
+		default:
 		}
 
-		if err := m.rdb.Watch(ctx, func(tx *redis.Tx) (err error) {
-			if val, err := tx.Get(ctx, m.name).Result(); err != nil {
-				return errors.Wrapf(err, "get key `%s`", m.name)
-			} else if val != m.clientID {
-				return errors.Errorf("another process `%s` take over this lock `%s`", val, m.name)
-			}
-
-			_, err = tx.TxPipelined(ctx, func(pp redis.Pipeliner) error {
-				pp.Expire(ctx, m.name, m.ttl)
-				return nil
-			})
-
-			err = errors.WithStack(err)
-			return
-		}, m.name); err != nil {
-			m.logger.Warn("renew lock", zap.String("dbkey", m.name), zap.Error(err))
-			return
+		if token, count, err = m.acquire(ctx, cid); err != nil {
+			return 0, 0, err
+		} else if token != 0 || !m.blocking {
+			return token, count, nil
 		}
 
-		m.logger.Debug("succeed renew lock", zap.String("lock", m.name))
+		waiter.wait(ctx)
 	}
 }
 
+// refreshLock keep lock held by cid alive until lease is ended
+func (m *mutex) refreshLock(lease *lockLease, cid string) {
+	keepAlive(lease, m.mutexOption, m.logger.With(zap.String("dbkey", m.name)),
+		func(ctx context.Context) (bool, error) {
+			return m.extend(ctx, cid)
+		},
+		func(ctx context.Context) error {
+			return m.notHeld(ctx, cid)
+		},
+	)
+}
+
 // Lock acquire a recursive lock
 //
 // if succeed acquired lock,
 //   - locked == true
 //   - lockCtx is context of lock, this context will be set to done when lock is expired
+//
+// return locked == false with ErrLockTaken if lock is held by others and not blocking.
 func (m *mutex) Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error) {
-	for {
-		select {
-		case <-ctx.Done():
-			return locked, lockCtx, ctx.Err()
-		default:
-		}
-
-		if locked, err = m.rdb.SetNX(ctx, m.name, m.clientID, m.ttl).Result(); err != nil {
-			return false, nil, errors.WithStack(err)
-		} else if !locked {
-			if val, err := m.rdb.Get(ctx, m.name).Result(); err != nil {
-				return false, nil, errors.Wrapf(err, "get `%s`", m.name)
-			} else if val != m.clientID {
-				// if val == m.clientID, means this client already acquired lock
-				if !m.blocking {
-					return false, nil, nil
-				}
-
-				time.Sleep(m.spinInterval)
-				continue
-			}
-		}
+	defer func(start time.Time) {
+		m.rdb.observe(ctx, "mutex", m.name, "lock", start, locked, err)
+	}(time.Now())
 
-		if m.cancel != nil {
-			m.cancel()
-		}
+	token, count, err := m.wait(ctx, m.clientID)
+	if err != nil {
+		return false, nil, err
+	} else if token == 0 {
+		return false, nil, errors.Wrapf(ErrLockTaken, "lock `%s`", m.name)
+	}
 
-		lockCtx, m.cancel = context.WithCancel(ctx)
-		go m.refreshLock(lockCtx, m.cancel)
-		return true, lockCtx, nil
+	lockCtx, lease := m.ctxs.acquired(ctx, count, m.onLost)
+	if lease != nil {
+		go m.refreshLock(lease, m.clientID)
 	}
+
+	return true, context.WithValue(lockCtx, fencingTokenCtxKey{}, token), nil
 }
 
 // Unlock release lock
-func (m *mutex) Unlock(ctx context.Context) error {
-	return errors.WithStack(m.rdb.Watch(ctx, func(tx *redis.Tx) (err error) {
-		if val, err := tx.Get(ctx, m.name).Result(); err != nil {
-			if !IsNil(err) {
-				return errors.Wrapf(err, "get key `%s`", m.name)
-			}
-
-			m.logger.Warn("lock not exists")
-			return nil
-		} else if val != m.clientID {
-			m.logger.Warn("another process already acquired this lock")
-			return nil
-		}
+//
+// lock will be released after the outermost Unlock.
+func (m *mutex) Unlock(ctx context.Context) (err error) {
+	defer func(start time.Time) {
+		m.rdb.observe(ctx, "mutex", m.name, "unlock", start, err == nil, err)
+	}(time.Now())
 
-		if _, err = tx.TxPipelined(ctx, func(pp redis.Pipeliner) error {
-			pp.Del(ctx, m.name)
-			return nil
-		}); err != nil {
-			return errors.WithStack(err)
-		}
+	remaining, err := m.release(ctx, m.clientID)
+	if err != nil {
+		return err
+	}
 
-		m.cancel()
-		m.cancel = nil
-		return
-	}, m.name))
+	if remaining < 0 {
+		m.logger.Warn("lock not exists or already acquired by another process",
+			zap.String("dbkey", m.name))
+		return m.notHeld(ctx, m.clientID)
+	}
+
+	m.ctxs.released(remaining)
+	return nil
+}
+
+// Acquire acquire a new non-reentrant lock, return its handle
+func (m *mutex) Acquire(ctx context.Context) (handle LockHandle, err error) {
+	defer func(start time.Time) {
+		m.rdb.observe(ctx, "mutex", m.name, "acquire", start, err == nil, err)
+	}(time.Now())
+
+	cid := newHandleClientID(m.clientID)
+	token, _, err := m.wait(ctx, cid)
+	if err != nil {
+		return nil, err
+	} else if token == 0 {
+		return nil, errors.Wrapf(ErrLockTaken, "lock `%s`", m.name)
+	}
+
+	lease := newLockLease(ctx, m.onLost)
+	go m.refreshLock(lease, cid)
+
+	return &lockHandle{
+		cid:   cid,
+		ctx:   context.WithValue(lease.ctx, fencingTokenCtxKey{}, token),
+		lease: lease,
+		extend: func(ctx context.Context) (bool, error) {
+			return m.extend(ctx, cid)
+		},
+		release: func(ctx context.Context) (bool, error) {
+			remaining, err := m.release(ctx, cid)
+			return remaining >= 0, err
+		},
+		ttl: func(ctx context.Context) (time.Duration, bool, error) {
+			return m.ttlOf(ctx, cid)
+		},
+		notHeld: func(ctx context.Context) error {
+			return m.notHeld(ctx, cid)
+		},
+	}, nil
 }
@@ -10,6 +10,8 @@ import (
 	gutils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
 	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -194,3 +196,419 @@ func TestUtils_NewMutex_race(t *testing.T) {
 
 	_ = pool.Wait()
 }
+
+func TestUtils_NewMutex_nonblocking(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	mu1, err := rtils.NewMutex(lockid)
+	require.NoError(t, err)
+	mu2, err := rtils.NewMutex(lockid, WithMutexBlockingLock(false))
+	require.NoError(t, err)
+
+	locked, _, err := mu1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	locked, _, err = mu2.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	// unlock by non-holder should not release the lock
+	err = mu2.Unlock(ctx)
+	require.ErrorIs(t, err, ErrLockNotHeld)
+	var lost *ErrLockLost
+	require.ErrorAs(t, err, &lost)
+	require.NotEmpty(t, lost.Owner)
+	locked, _, err = mu2.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	require.NoError(t, mu1.Unlock(ctx))
+	locked, _, err = mu2.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, mu2.Unlock(ctx))
+}
+
+func TestUtils_NewMutex_releaseNotify(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	mu1, err := rtils.NewMutex(lockid)
+	require.NoError(t, err)
+	mu2, err := rtils.NewMutex(lockid,
+		WithMutexNotifyFallbackInterval(time.Minute),
+	)
+	require.NoError(t, err)
+
+	locked, _, err := mu1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := mu1.Unlock(ctx); err != nil {
+			logger.Panic("unlock", zap.Error(err))
+		}
+	}()
+
+	start := time.Now()
+	locked, _, err = mu2.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.Less(t, time.Since(start), time.Second)
+	require.NoError(t, mu2.Unlock(ctx))
+}
+
+func TestUtils_NewMutex_fencingToken(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, ok := FencingToken(ctx)
+	require.False(t, ok)
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	mu1, err := rtils.NewMutex(lockid)
+	require.NoError(t, err)
+	mu2, err := rtils.NewMutex(lockid)
+	require.NoError(t, err)
+
+	locked, lockCtx, err := mu1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	token1, ok := FencingToken(lockCtx)
+	require.True(t, ok)
+	require.Greater(t, token1, int64(0))
+
+	// reentrant lock get the same token
+	_, lockCtx, err = mu1.Lock(ctx)
+	require.NoError(t, err)
+	token, ok := FencingToken(lockCtx)
+	require.True(t, ok)
+	require.Equal(t, token1, token)
+	require.NoError(t, mu1.Unlock(ctx))
+	require.NoError(t, mu1.Unlock(ctx))
+
+	_, lockCtx, err = mu2.Lock(ctx)
+	require.NoError(t, err)
+	token2, ok := FencingToken(lockCtx)
+	require.True(t, ok)
+	require.Greater(t, token2, token1)
+	require.NoError(t, mu2.Unlock(ctx))
+}
+
+func TestUtils_NewMutex_reentrant(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	mu1, err := rtils.NewMutex(lockid)
+	require.NoError(t, err)
+	mu2, err := rtils.NewMutex(lockid, WithMutexBlockingLock(false))
+	require.NoError(t, err)
+
+	locked, outerCtx, err := mu1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	locked, innerCtx1, err := mu1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	locked, innerCtx2, err := mu1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// reentry should not cancel previous lockCtx
+	require.NoError(t, outerCtx.Err())
+	require.NoError(t, innerCtx1.Err())
+
+	// inner unlock only release inner lockCtx
+	require.NoError(t, mu1.Unlock(ctx))
+	require.Error(t, innerCtx2.Err())
+	require.NoError(t, innerCtx1.Err())
+	require.NoError(t, outerCtx.Err())
+
+	locked, _, err = mu2.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	require.NoError(t, mu1.Unlock(ctx))
+	require.Error(t, innerCtx1.Err())
+	require.NoError(t, outerCtx.Err())
+
+	locked, _, err = mu2.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	// outermost unlock release lock
+	require.NoError(t, mu1.Unlock(ctx))
+	require.Error(t, outerCtx.Err())
+
+	locked, _, err = mu2.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, mu2.Unlock(ctx))
+}
+
+func TestMutex_Acquire(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	mu, err := rtils.NewMutex(lockid, WithMutexBlockingLock(false))
+	require.NoError(t, err)
+
+	h1, err := mu.Acquire(ctx)
+	require.NoError(t, err)
+	token1, ok := FencingToken(h1.Ctx())
+	require.True(t, ok)
+
+	// handles of the same mutex exclude each other
+	_, err = mu.Acquire(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.ErrorIs(t, err, ErrNotAcquired)
+
+	ttl, err := h1.TTL(ctx)
+	require.NoError(t, err)
+	require.Greater(t, ttl, time.Duration(0))
+	require.NoError(t, h1.Extend(ctx))
+
+	require.NoError(t, h1.Unlock(ctx))
+	require.Error(t, h1.Ctx().Err())
+	require.ErrorIs(t, h1.Unlock(ctx), ErrLockReleased)
+	require.ErrorIs(t, h1.Extend(ctx), ErrLockReleased)
+
+	h2, err := mu.Acquire(ctx)
+	require.NoError(t, err)
+	token2, ok := FencingToken(h2.Ctx())
+	require.True(t, ok)
+	require.Greater(t, token2, token1)
+
+	// lock is taken over after handle expired
+	require.NoError(t, rdb.Del(ctx, rtils.buildKey(defaultKeySyncMutex, lockid)).Err())
+	require.ErrorIs(t, h2.Extend(ctx), ErrLockNotHeld)
+	require.Error(t, h2.Ctx().Err())
+	_, err = h2.TTL(ctx)
+	require.ErrorIs(t, err, ErrLockNotHeld)
+	require.ErrorIs(t, h2.Unlock(ctx), ErrLockNotHeld)
+}
+
+func TestMutex_Acquire_concurrent(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	mu, err := rtils.NewMutex("laisky"+gutils.RandomStringWithLength(10),
+		WithMutexSpinInterval(10*time.Millisecond))
+	require.NoError(t, err)
+
+	var (
+		pool    errgroup.Group
+		holders int32
+	)
+	for i := 0; i < 10; i++ {
+		pool.Go(func() error {
+			h, err := mu.Acquire(ctx)
+			if err != nil {
+				return err
+			}
+
+			if n := atomic.AddInt32(&holders, 1); n != 1 {
+				return errors.Errorf("%d holders at the same time", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+
+			return h.Unlock(ctx)
+		})
+	}
+
+	require.NoError(t, pool.Wait())
+}
+
+func TestMutex_Unlock_notHeld(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mu, err := rtils.NewMutex("laisky" + gutils.RandomStringWithLength(10))
+	require.NoError(t, err)
+	require.ErrorIs(t, mu.Unlock(ctx), ErrLockNotHeld)
+
+	locked, _, err := mu.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, mu.Unlock(ctx))
+	require.ErrorIs(t, mu.Unlock(ctx), ErrLockNotHeld)
+}
+
+func TestMutex_Acquire_lost(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	mu, err := rtils.NewMutex(lockid)
+	require.NoError(t, err)
+
+	h, err := mu.Acquire(ctx)
+	require.NoError(t, err)
+
+	// lock is taken over by another client
+	require.NoError(t, rdb.HSet(ctx, rtils.buildKey(defaultKeySyncMutex, lockid), "owner", "other").Err())
+	err = h.Extend(ctx)
+	require.ErrorIs(t, err, ErrLockNotHeld)
+	var lost *ErrLockLost
+	require.ErrorAs(t, err, &lost)
+	require.Equal(t, "other", lost.Owner)
+	require.Error(t, h.Ctx().Err())
+}
+
+// failingHook fail all commands when enabled
+type failingHook struct {
+	enabled int32
+}
+
+func (h *failingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if atomic.LoadInt32(&h.enabled) == 1 {
+		return ctx, errors.New("redis unreachable")
+	}
+
+	return ctx, nil
+}
+
+func (h *failingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *failingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.BeforeProcess(ctx, nil)
+}
+
+func (h *failingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestMutex_OnLost(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	hook := new(failingHook)
+	rdb.AddHook(hook)
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	lockKey := rtils.buildKey(defaultKeySyncMutex, lockid)
+	reasons := make(chan error, 1)
+	mu, err := rtils.NewMutex(lockid,
+		WithMutexTTL(500*time.Millisecond),
+		WithMutexRefreshInterval(100*time.Millisecond),
+		WithMutexRefreshRetryInterval(20*time.Millisecond),
+		WithMutexOnLost(func(reason error) {
+			reasons <- reason
+		}),
+	)
+	require.NoError(t, err)
+
+	t.Run("unlock", func(t *testing.T) {
+		locked, lockCtx, err := mu.Lock(ctx)
+		require.NoError(t, err)
+		require.True(t, locked)
+		require.NoError(t, mu.Unlock(ctx))
+		require.ErrorIs(t, <-reasons, ErrLockReleased)
+		require.Error(t, lockCtx.Err())
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		h, err := mu.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, rdb.Del(ctx, lockKey).Err())
+		require.ErrorIs(t, <-reasons, ErrLockExpired)
+		<-h.Ctx().Done()
+	})
+
+	t.Run("stolen", func(t *testing.T) {
+		h, err := mu.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, rdb.HSet(ctx, lockKey, "owner", "other").Err())
+
+		var lost *ErrLockLost
+		require.ErrorAs(t, <-reasons, &lost)
+		require.Equal(t, "other", lost.Owner)
+		<-h.Ctx().Done()
+		require.NoError(t, rdb.Del(ctx, lockKey).Err())
+	})
+
+	t.Run("transient error", func(t *testing.T) {
+		h, err := mu.Acquire(ctx)
+		require.NoError(t, err)
+
+		atomic.StoreInt32(&hook.enabled, 1)
+		time.Sleep(250 * time.Millisecond)
+		atomic.StoreInt32(&hook.enabled, 0)
+		time.Sleep(300 * time.Millisecond)
+
+		require.NoError(t, h.Ctx().Err())
+		require.NoError(t, h.Unlock(ctx))
+		require.ErrorIs(t, <-reasons, ErrLockReleased)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		h, err := mu.Acquire(ctx)
+		require.NoError(t, err)
+
+		atomic.StoreInt32(&hook.enabled, 1)
+		start := time.Now()
+		require.ErrorIs(t, <-reasons, ErrLockUnreachable)
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+		<-h.Ctx().Done()
+		atomic.StoreInt32(&hook.enabled, 0)
+	})
+}
+
+func TestUtils_NewLocks_invalidRefreshGrace(t *testing.T) {
+	rtils := NewRedisUtils(redis.NewClient(&redis.Options{}))
+
+	// grace not less than ttl makes every acquisition lost at once
+	_, err := rtils.NewMutex("laisky",
+		WithMutexTTL(time.Second), WithMutexRefreshGrace(time.Second))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewSemaphore("laisky", 1,
+		WithSemaphoreTTL(time.Second), WithSemaphoreRefreshGrace(2*time.Second))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewRWMutex("laisky",
+		WithRWMutexTTL(time.Second), WithRWMutexRefreshGrace(time.Second))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = NewRedlock("laisky", []*Utils{rtils},
+		WithMutexTTL(time.Second), WithMutexRefreshGrace(990*time.Millisecond))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+
+	// order of options does not matter
+	_, err = rtils.NewMutex("laisky",
+		WithMutexRefreshGrace(500*time.Millisecond), WithMutexTTL(time.Second))
+	require.NoError(t, err)
+}
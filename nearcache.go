@@ -0,0 +1,475 @@
+package redis
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultNearCacheSize = 1000
+	defaultNearCacheTTL  = time.Minute
+	// nearCacheTrackingChannel channel of client-side caching invalidation
+	nearCacheTrackingChannel = "__redis__:invalidate"
+	nearCacheSetupTimeout    = 5 * time.Second
+)
+
+// NearCache two-tier cache, local LRU in front of redis
+//
+// Redis keys:
+//
+//	`/rtils/nearcache/{<cache_name>}/invalidate`: pub/sub channel of invalidated keys
+//
+// Implementations:
+//
+//   - Get: read local copy, or `GET` from redis then save local copy with local ttl
+//   - Set/Delete: write redis, evict local copy, then publish the key to
+//     invalidation channel, all instances with the same name evict their local copies
+//   - tracking(optional): redis server tracks keys match prefixes by
+//     `CLIENT TRACKING on REDIRECT <id> BCAST`, and sends invalidation
+//     to `__redis__:invalidate` once they are modified by anyone,
+//     not only writes through near cache.
+//
+// local copies may be stale for at most local ttl
+// if invalidation message is lost, e.g. reconnecting.
+type NearCache interface {
+	// Get get value, return redis.Nil if not exists
+	Get(ctx context.Context, key string) (string, error)
+	// Set set value, invalidate local copies of all instances
+	Set(ctx context.Context, key, val string, exp time.Duration) error
+	// Delete delete keys, invalidate local copies of all instances
+	Delete(ctx context.Context, keys ...string) error
+	// Close stop receiving invalidation
+	Close() error
+}
+
+type nearCacheOption struct {
+	size             int
+	ttl              time.Duration
+	tracking         bool
+	trackingPrefixes []string
+}
+
+type nearCache struct {
+	nearCacheOption
+	rdb     *Utils
+	logger  gutils.LoggerItf
+	name    string
+	channel string
+	local   *lruCache
+	// gen increased on every invalidation,
+	// value read from redis will not be saved if gen changed during reading
+	gen     uint64
+	pubsub  *redis.PubSub
+	tracker *nearCacheTracker
+	wg      sync.WaitGroup
+}
+
+// NearCacheOptionFunc options for near cache
+type NearCacheOptionFunc func(*nearCache) error
+
+// WithNearCacheSize set max items of local cache
+func WithNearCacheSize(size int) NearCacheOptionFunc {
+	return func(c *nearCache) error {
+		if size <= 0 {
+			return errors.Errorf("size must greater than 0")
+		}
+
+		c.size = size
+		return nil
+	}
+}
+
+// WithNearCacheTTL set ttl of local copies
+func WithNearCacheTTL(ttl time.Duration) NearCacheOptionFunc {
+	return func(c *nearCache) error {
+		if ttl <= 0 {
+			return errors.Errorf("ttl must greater than 0")
+		}
+
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// WithNearCacheTracking enable server-assisted client side caching
+// by `CLIENT TRACKING` in broadcasting mode,
+// only keys match prefixes are tracked, empty prefixes means all keys.
+//
+// requires redis 6 and `*redis.Client`,
+// falls back to pub/sub invalidation if not supported.
+func WithNearCacheTracking(prefixes ...string) NearCacheOptionFunc {
+	return func(c *nearCache) error {
+		c.tracking = true
+		c.trackingPrefixes = prefixes
+		return nil
+	}
+}
+
+// WithNearCacheLogger set near cache's logger
+func WithNearCacheLogger(logger *gutils.LoggerType) NearCacheOptionFunc {
+	return func(c *nearCache) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// NewNearCache new two-tier cache,
+// instances with the same name share invalidation
+func (u *Utils) NewNearCache(name string, opts ...NearCacheOptionFunc) (NearCache, error) {
+	c := &nearCache{
+		rdb:     u,
+		logger:  u.logger,
+		name:    name,
+		channel: u.buildKey(defaultKeyNearCacheInvalidate, name),
+		nearCacheOption: nearCacheOption{
+			size: defaultNearCacheSize,
+			ttl:  defaultNearCacheTTL,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(c); err != nil {
+			return nil, err
+		}
+	}
+
+	c.logger = c.logger.With(zap.String("near_cache", name))
+	c.local = newLRUCache(c.size)
+
+	ctx, cancel := context.WithTimeout(context.Background(), nearCacheSetupTimeout)
+	defer cancel()
+
+	if c.tracking {
+		if err := c.startTracking(ctx); err != nil {
+			c.logger.Warn("enable client tracking, fallback to pub/sub invalidation", zap.Error(err))
+		}
+	}
+
+	if c.pubsub == nil {
+		c.pubsub = u.Subscribe(ctx, c.channel)
+		if _, err := c.pubsub.Receive(ctx); err != nil {
+			_ = c.pubsub.Close()
+			return nil, errors.Wrapf(err, "subscribe `%s`", c.channel)
+		}
+	}
+
+	c.wg.Add(1)
+	go c.runInvalidation()
+	return c, nil
+}
+
+// startTracking subscribe invalidation channels on dedicated connection,
+// then enable tracking on reading connections redirect to it
+func (c *nearCache) startTracking(ctx context.Context) error {
+	rdb, ok := c.rdb.UniversalClient.(*redis.Client)
+	if !ok {
+		return errors.Errorf("client tracking requires *redis.Client")
+	}
+	if !c.rdb.supports(ctx, capClientTracking) {
+		return errors.Errorf("client tracking requires redis 6")
+	}
+
+	c.tracker = newNearCacheTracker(rdb.Options(), c.trackingPrefixes, c.flush)
+	pubsub := c.tracker.sub.Subscribe(ctx, c.channel, nearCacheTrackingChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		c.tracker.close()
+		c.tracker = nil
+		return errors.Wrap(err, "subscribe invalidation")
+	}
+
+	// connect reader to enable tracking
+	if err := c.tracker.client().Ping(ctx).Err(); err != nil {
+		_ = pubsub.Close()
+		c.tracker.close()
+		c.tracker = nil
+		return err
+	}
+
+	c.pubsub = pubsub
+	return nil
+}
+
+// runInvalidation evict local copies by invalidation messages
+func (c *nearCache) runInvalidation() {
+	defer c.wg.Done()
+	for msg := range c.pubsub.Channel() {
+		switch msg.Channel {
+		case c.channel:
+			c.evict(msg.Payload)
+		case nearCacheTrackingChannel:
+			// null means flush all
+			if len(msg.PayloadSlice) == 0 && msg.Payload == "" {
+				c.flush()
+			} else if len(msg.PayloadSlice) != 0 {
+				c.evict(msg.PayloadSlice...)
+			} else {
+				c.evict(msg.Payload)
+			}
+		}
+	}
+}
+
+func (c *nearCache) evict(keys ...string) {
+	atomic.AddUint64(&c.gen, 1)
+	c.local.del(keys...)
+}
+
+func (c *nearCache) flush() {
+	atomic.AddUint64(&c.gen, 1)
+	c.local.flush()
+}
+
+// Get get value, return redis.Nil if not exists
+func (c *nearCache) Get(ctx context.Context, key string) (string, error) {
+	if val, ok := c.local.get(key, c.rdb.clock.GetUTCNow()); ok {
+		return val, nil
+	}
+
+	var reader redis.Cmdable = c.rdb.UniversalClient
+	if c.tracker != nil {
+		reader = c.tracker.client()
+	}
+
+	gen := atomic.LoadUint64(&c.gen)
+	val, err := reader.Get(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+
+	if atomic.LoadUint64(&c.gen) == gen {
+		c.local.set(key, val, c.rdb.clock.GetUTCNow().Add(c.ttl))
+	}
+
+	return val, nil
+}
+
+// Set set value, invalidate local copies of all instances
+func (c *nearCache) Set(ctx context.Context, key, val string, exp time.Duration) error {
+	if err := c.rdb.UniversalClient.Set(ctx, key, val, exp).Err(); err != nil {
+		return errors.Wrapf(err, "set `%s`", key)
+	}
+
+	return c.invalidate(ctx, key)
+}
+
+// Delete delete keys, invalidate local copies of all instances
+func (c *nearCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if err := c.rdb.UniversalClient.Del(ctx, keys...).Err(); err != nil {
+		return errors.Wrapf(err, "delete `%v`", keys)
+	}
+
+	return c.invalidate(ctx, keys...)
+}
+
+// invalidate evict local copies, then notify other instances
+func (c *nearCache) invalidate(ctx context.Context, keys ...string) error {
+	c.evict(keys...)
+	if _, err := c.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			p.Publish(ctx, c.channel, key)
+		}
+
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "publish invalidation of `%v`", keys)
+	}
+
+	return nil
+}
+
+// Close stop receiving invalidation
+func (c *nearCache) Close() error {
+	err := c.pubsub.Close()
+	c.wg.Wait()
+	if c.tracker != nil {
+		c.tracker.close()
+	}
+
+	c.local.flush()
+	return err
+}
+
+// nearCacheTracker dedicated clients for client tracking
+//
+// sub receives invalidation, reader reads keys with tracking enabled
+// and redirects invalidation to sub's connection.
+// once sub reconnected, its client id changed,
+// reader will be recreated to redirect to the new id.
+type nearCacheTracker struct {
+	sub      *redis.Client
+	redirect int64
+	connects int32
+
+	readerOpt redis.Options
+	mu        sync.Mutex
+	reader    *redis.Client
+	stale     bool
+}
+
+func newNearCacheTracker(base *redis.Options, prefixes []string, onReconnect func()) *nearCacheTracker {
+	t := &nearCacheTracker{}
+
+	subOpt := *base
+	subOpt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if base.OnConnect != nil {
+			if err := base.OnConnect(ctx, cn); err != nil {
+				return err
+			}
+		}
+
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return errors.Wrap(err, "get client id")
+		}
+
+		atomic.StoreInt64(&t.redirect, id)
+		if atomic.AddInt32(&t.connects, 1) > 1 {
+			t.mu.Lock()
+			t.stale = true
+			t.mu.Unlock()
+			onReconnect()
+		}
+
+		return nil
+	}
+	t.sub = redis.NewClient(&subOpt)
+
+	t.readerOpt = *base
+	t.readerOpt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if base.OnConnect != nil {
+			if err := base.OnConnect(ctx, cn); err != nil {
+				return err
+			}
+		}
+
+		args := []interface{}{"CLIENT", "TRACKING", "ON",
+			"REDIRECT", atomic.LoadInt64(&t.redirect), "BCAST"}
+		for _, prefix := range prefixes {
+			args = append(args, "PREFIX", prefix)
+		}
+
+		cmd := redis.NewStatusCmd(ctx, args...)
+		_ = cn.Process(ctx, cmd)
+		return errors.Wrap(cmd.Err(), "enable client tracking")
+	}
+
+	return t
+}
+
+// client reader with tracking enabled
+func (t *nearCacheTracker) client() *redis.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reader == nil || t.stale {
+		if t.reader != nil {
+			_ = t.reader.Close()
+		}
+
+		t.reader = redis.NewClient(&t.readerOpt)
+		t.stale = false
+	}
+
+	return t.reader
+}
+
+func (t *nearCacheTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reader != nil {
+		_ = t.reader.Close()
+	}
+
+	_ = t.sub.Close()
+}
+
+// lruCache bounded local cache with ttl
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key, val string
+	expireAt time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *lruCache) get(key string, now time.Time) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ele, ok := l.items[key]
+	if !ok {
+		return "", false
+	}
+
+	e := ele.Value.(*lruEntry)
+	if now.After(e.expireAt) {
+		l.ll.Remove(ele)
+		delete(l.items, key)
+		return "", false
+	}
+
+	l.ll.MoveToFront(ele)
+	return e.val, true
+}
+
+func (l *lruCache) set(key, val string, expireAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ele, ok := l.items[key]; ok {
+		e := ele.Value.(*lruEntry)
+		e.val, e.expireAt = val, expireAt
+		l.ll.MoveToFront(ele)
+		return
+	}
+
+	l.items[key] = l.ll.PushFront(&lruEntry{key: key, val: val, expireAt: expireAt})
+	for l.ll.Len() > l.size {
+		ele := l.ll.Back()
+		l.ll.Remove(ele)
+		delete(l.items, ele.Value.(*lruEntry).key)
+	}
+}
+
+func (l *lruCache) del(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		if ele, ok := l.items[key]; ok {
+			l.ll.Remove(ele)
+			delete(l.items, key)
+		}
+	}
+}
+
+func (l *lruCache) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ll.Init()
+	l.items = make(map[string]*list.Element)
+}
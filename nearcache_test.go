@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewNearCache(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := "laisky" + gutils.RandomStringWithLength(10)
+	c1, err := rtils.NewNearCache(name)
+	require.NoError(t, err)
+	defer c1.Close()
+
+	// falls back to pub/sub invalidation if tracking not supported
+	c2, err := rtils.NewNearCache(name, WithNearCacheTracking("/TestUtils_NewNearCache/"))
+	require.NoError(t, err)
+	defer c2.Close()
+
+	key := "/TestUtils_NewNearCache/" + gutils.RandomStringWithLength(10)
+	_, err = c1.Get(ctx, key)
+	require.True(t, IsNil(err))
+
+	require.NoError(t, rdb.Set(ctx, key, "v1", time.Minute).Err())
+	val, err := c2.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, "v1", val)
+
+	// served by local copy
+	require.NoError(t, rdb.Set(ctx, key, "changed", time.Minute).Err())
+	val, err = c2.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, "v1", val)
+
+	// invalidated by other instance
+	require.NoError(t, c1.Set(ctx, key, "v2", time.Minute))
+	require.Eventually(t, func() bool {
+		val, err := c2.Get(ctx, key)
+		return err == nil && val == "v2"
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, c1.Delete(ctx, key))
+	require.Eventually(t, func() bool {
+		_, err := c2.Get(ctx, key)
+		return IsNil(err)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLRUCache(t *testing.T) {
+	l := newLRUCache(2)
+	now := time.Now()
+
+	l.set("a", "1", now.Add(time.Minute))
+	l.set("b", "2", now.Add(time.Minute))
+	_, ok := l.get("a", now)
+	require.True(t, ok)
+
+	// evict least recently used
+	l.set("c", "3", now.Add(time.Minute))
+	_, ok = l.get("b", now)
+	require.False(t, ok)
+
+	// expired
+	_, ok = l.get("a", now.Add(2*time.Minute))
+	require.False(t, ok)
+
+	l.flush()
+	_, ok = l.get("c", now)
+	require.False(t, ok)
+}
@@ -0,0 +1,134 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// lockWaiter block lock waiters until lock may be available.
+//
+// waiter subscribes the release channel of the lock,
+// and wakes up immediately when the holder publishes release message.
+// in case of the notification is lost (or lock is expired without release),
+// waiter still retries every `fallbackInterval`.
+//
+// if subscription is disabled or failed, waiter falls back to spin every `spinInterval`.
+type lockWaiter struct {
+	rdb     *Utils
+	logger  gutils.LoggerItf
+	channel string
+	// subscriptions subscribe channels on specified nodes instead of `rdb`,
+	// waiter wakes up once any of them is notified
+	subscriptions []waiterSubscription
+
+	spinInterval,
+	fallbackInterval time.Duration
+	disabled bool
+
+	pubsubs []*redis.PubSub
+	notify  <-chan *redis.Message
+}
+
+// waiterSubscription channel subscribed on specified node
+type waiterSubscription struct {
+	client  *redis.Client
+	channel string
+}
+
+func newLockWaiter(rdb *Utils, logger gutils.LoggerItf, channel string, opt *mutexOption) *lockWaiter {
+	return &lockWaiter{
+		rdb:              rdb,
+		logger:           logger,
+		channel:          channel,
+		spinInterval:     opt.spinInterval,
+		fallbackInterval: opt.notifyFallbackInterval,
+		disabled:         !opt.releaseNotify,
+	}
+}
+
+// subscribe subscribe release channel, wait until subscription is confirmed
+func (w *lockWaiter) subscribe(ctx context.Context) error {
+	var pubsubs []*redis.PubSub
+	if len(w.subscriptions) == 0 {
+		pubsubs = append(pubsubs, w.rdb.Subscribe(ctx, w.channel))
+	}
+	for _, sub := range w.subscriptions {
+		pubsubs = append(pubsubs, sub.client.Subscribe(ctx, sub.channel))
+	}
+
+	for _, pubsub := range pubsubs {
+		if _, err := pubsub.Receive(ctx); err != nil {
+			for _, pubsub := range pubsubs {
+				_ = pubsub.Close()
+			}
+
+			return errors.Wrapf(err, "subscribe `%s`", w.channel)
+		}
+	}
+
+	w.pubsubs = pubsubs
+	if len(pubsubs) == 1 {
+		w.notify = pubsubs[0].Channel()
+		return nil
+	}
+
+	// fan in, forwarding goroutines exit once pubsubs are closed
+	notify := make(chan *redis.Message, 1)
+	for _, pubsub := range pubsubs {
+		go func(ch <-chan *redis.Message) {
+			for msg := range ch {
+				select {
+				case notify <- msg:
+				default:
+				}
+			}
+		}(pubsub.Channel())
+	}
+
+	w.notify = notify
+	return nil
+}
+
+// wait block until lock may be available or ctx done
+func (w *lockWaiter) wait(ctx context.Context) {
+	if !w.disabled && w.pubsubs == nil {
+		if err := w.subscribe(ctx); err != nil {
+			w.logger.Warn("subscribe lock release, fallback to spin",
+				zap.String("channel", w.channel), zap.Error(err))
+			w.disabled = true
+		} else {
+			// lock may be released before subscribed, retry immediately
+			return
+		}
+	}
+
+	interval := w.spinInterval
+	if w.pubsubs != nil {
+		interval = w.fallbackInterval
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-w.notify: // nil channel blocks forever if not subscribed
+	}
+}
+
+// close release subscription
+func (w *lockWaiter) close() {
+	for _, pubsub := range w.pubsubs {
+		if err := pubsub.Close(); err != nil {
+			w.logger.Warn("close subscription", zap.String("channel", w.channel), zap.Error(err))
+		}
+	}
+
+	w.pubsubs = nil
+	w.notify = nil
+}
@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec marshal and unmarshal objects stored in redis
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encoding/json
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec github.com/vmihailenco/msgpack/v5
+	MsgpackCodec Codec = msgpackCodec{}
+	// GobCodec encoding/gob
+	GobCodec Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// header byte of stored objects
+const (
+	objectHeaderRaw byte = iota
+	objectHeaderGzip
+)
+
+const (
+	// defaultObjectCompressThreshold compression is disabled by default
+	defaultObjectCompressThreshold = 0
+)
+
+type objectOption struct {
+	codec             Codec
+	compressThreshold int
+}
+
+// ObjectOptionFunc options for object helpers
+type ObjectOptionFunc func(*objectOption) error
+
+// WithObjectCodec set codec of objects, default is `JSONCodec`
+func WithObjectCodec(codec Codec) ObjectOptionFunc {
+	return func(opt *objectOption) error {
+		if codec == nil {
+			return errors.Errorf("codec must not be nil")
+		}
+
+		opt.codec = codec
+		return nil
+	}
+}
+
+// WithObjectCompressThreshold gzip objects larger than threshold bytes,
+// 0 means disable compression.
+//
+// objects are decompressed automatically whatever this option is.
+func WithObjectCompressThreshold(threshold int) ObjectOptionFunc {
+	return func(opt *objectOption) error {
+		if threshold < 0 {
+			return errors.Errorf("threshold must not less than 0")
+		}
+
+		opt.compressThreshold = threshold
+		return nil
+	}
+}
+
+func newObjectOption(opts []ObjectOptionFunc) (*objectOption, error) {
+	opt := &objectOption{
+		codec:             JSONCodec,
+		compressThreshold: defaultObjectCompressThreshold,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	return opt, nil
+}
+
+// encode marshal object, then prepend header byte
+func (opt *objectOption) encode(v interface{}) ([]byte, error) {
+	data, err := opt.codec.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal")
+	}
+
+	if opt.compressThreshold == 0 || len(data) <= opt.compressThreshold {
+		return append([]byte{objectHeaderRaw}, data...), nil
+	}
+
+	buf := bytes.NewBuffer([]byte{objectHeaderGzip})
+	gz := gzip.NewWriter(buf)
+	if _, err = gz.Write(data); err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+	if err = gz.Close(); err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decode strip header byte, then unmarshal object
+func (opt *objectOption) decode(data []byte, v interface{}) (err error) {
+	if len(data) == 0 {
+		return errors.Errorf("empty object")
+	}
+
+	switch data[0] {
+	case objectHeaderRaw:
+		data = data[1:]
+	case objectHeaderGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return errors.Wrap(err, "decompress")
+		}
+
+		if data, err = io.ReadAll(gz); err != nil {
+			return errors.Wrap(err, "decompress")
+		}
+	default:
+		return errors.Errorf("unknown object header `%d`", data[0])
+	}
+
+	return errors.Wrap(opt.codec.Unmarshal(data, v), "unmarshal")
+}
+
+// GetObject get object stored by `SetObject`
+//
+// return redis.Nil if key not exists, could be checked by `IsNil`.
+func GetObject[T any](ctx context.Context, u *Utils, key string, opts ...ObjectOptionFunc) (obj T, err error) {
+	opt, err := newObjectOption(opts)
+	if err != nil {
+		return obj, err
+	}
+
+	data, err := u.UniversalClient.Get(ctx, key).Bytes()
+	if err != nil {
+		return obj, errors.Wrapf(err, "get `%s`", key)
+	}
+
+	if err = opt.decode(data, &obj); err != nil {
+		return obj, errors.Wrapf(err, "decode `%s`", key)
+	}
+
+	return obj, nil
+}
+
+// SetObject set object with expiration
+func SetObject[T any](ctx context.Context, u *Utils, key string, obj T, exp time.Duration, opts ...ObjectOptionFunc) error {
+	opt, err := newObjectOption(opts)
+	if err != nil {
+		return err
+	}
+
+	data, err := opt.encode(obj)
+	if err != nil {
+		return errors.Wrapf(err, "encode `%s`", key)
+	}
+
+	if err = u.UniversalClient.Set(ctx, key, data, exp).Err(); err != nil {
+		return errors.Wrapf(err, "set `%s`", key)
+	}
+
+	return nil
+}
+
+// MGetObjects get objects stored by `SetObject`, return `map[key]: obj`,
+// keys not exists are omitted.
+//
+// keys could be located in different slots of cluster or shards of ring.
+func MGetObjects[T any](ctx context.Context, u *Utils, keys []string, opts ...ObjectOptionFunc) (map[string]T, error) {
+	opt, err := newObjectOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make(map[string]T, len(keys))
+	if len(keys) == 0 {
+		return objs, nil
+	}
+
+	vals, err := u.mget(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range vals {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		var obj T
+		if err = opt.decode([]byte(data), &obj); err != nil {
+			return nil, errors.Wrapf(err, "decode `%s`", keys[i])
+		}
+
+		objs[keys[i]] = obj
+	}
+
+	return objs, nil
+}
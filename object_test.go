@@ -0,0 +1,95 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+type testObject struct {
+	Name string
+	Tags []string
+}
+
+func TestObject(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for name, codec := range map[string]Codec{
+		"json":    JSONCodec,
+		"msgpack": MsgpackCodec,
+		"gob":     GobCodec,
+	} {
+		t.Run(name, func(t *testing.T) {
+			prefix := "/TestObject/" + gutils.RandomStringWithLength(10) + "/"
+			small := testObject{Name: "small", Tags: []string{"a"}}
+			large := testObject{Name: strings.Repeat("large", 100)}
+			opts := []ObjectOptionFunc{
+				WithObjectCodec(codec),
+				WithObjectCompressThreshold(100),
+			}
+
+			require.NoError(t, SetObject(ctx, rtils, prefix+"small", small, KeyExpImmortal, opts...))
+			require.NoError(t, SetObject(ctx, rtils, prefix+"large", large, KeyExpImmortal, opts...))
+
+			raw, err := rdb.Get(ctx, prefix+"small").Bytes()
+			require.NoError(t, err)
+			require.Equal(t, objectHeaderRaw, raw[0])
+			raw, err = rdb.Get(ctx, prefix+"large").Bytes()
+			require.NoError(t, err)
+			require.Equal(t, objectHeaderGzip, raw[0])
+			require.Less(t, len(raw), len(large.Name))
+
+			got, err := GetObject[testObject](ctx, rtils, prefix+"large", WithObjectCodec(codec))
+			require.NoError(t, err)
+			require.Equal(t, large, got)
+
+			_, err = GetObject[testObject](ctx, rtils, prefix+"notexists", opts...)
+			require.True(t, IsNil(err))
+
+			objs, err := MGetObjects[testObject](ctx, rtils,
+				[]string{prefix + "small", prefix + "notexists", prefix + "large"}, opts...)
+			require.NoError(t, err)
+			require.Len(t, objs, 2)
+			require.Equal(t, small, objs[prefix+"small"])
+		})
+	}
+}
+
+func TestMGetObjects_ring(t *testing.T) {
+	rdb := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"a": "127.0.0.1:6379", "b": "127.0.0.1:6379"},
+		NewClient: func(name string, opt *redis.Options) *redis.Client {
+			// shards on different db
+			opt.DB = map[string]int{"a": 4, "b": 5}[name]
+			return redis.NewClient(opt)
+		},
+	})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prefix := "/TestMGetObjects_ring/" + gutils.RandomStringWithLength(10) + "/"
+	keys := []string{prefix + "notexists"}
+	for i := 0; i < 20; i++ {
+		key := prefix + gutils.RandomStringWithLength(10)
+		require.NoError(t, SetObject(ctx, rtils, key, testObject{Name: key}, KeyExpImmortal))
+		keys = append(keys, key)
+	}
+
+	objs, err := MGetObjects[testObject](ctx, rtils, keys)
+	require.NoError(t, err)
+	require.Len(t, objs, 20)
+	for _, key := range keys[1:] {
+		require.Equal(t, key, objs[key].Name)
+	}
+}
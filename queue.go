@@ -0,0 +1,545 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultQueueVisibilityTimeout = 30 * time.Second
+	defaultQueueMaxRetries        = 3
+	defaultQueueReapInterval      = time.Second
+	defaultQueueBlockTimeout      = time.Second
+)
+
+// queueDeadlineScript set member's deadline by redis server's time
+//
+// KEYS[1]: sorted set of deadlines, e.g. deadlines of messages or consumers
+// ARGV[1]: member, e.g. raw message or consumer id
+// ARGV[2]: timeout in milliseconds
+var queueDeadlineScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+return 1
+`)
+
+// queueAckScript delete acked message from processing list
+//
+// KEYS[1]: processing
+// KEYS[2]: deadlines
+// ARGV[1]: raw message
+//
+// return 1 if deleted, 0 if message is not in processing list
+var queueAckScript = redis.NewScript(`
+redis.call("ZREM", KEYS[2], ARGV[1])
+return redis.call("LREM", KEYS[1], 1, ARGV[1])
+`)
+
+// queueRequeueLua move message from processing list back to the tail of ready list,
+// or to dead-letter list if exceeded retry limit.
+//
+// KEYS[1]: processing
+// KEYS[2]: deadlines
+// KEYS[3]: ready
+// KEYS[4]: dead
+// ARGV[1]: max retries
+const queueRequeueLua = `
+local function requeue(raw)
+	if redis.call("LREM", KEYS[1], 1, raw) == 0 then
+		return -1
+	end
+	redis.call("ZREM", KEYS[2], raw)
+
+	local ok, msg = pcall(cjson.decode, raw)
+	if not ok or type(msg) ~= "table" then
+		msg = {id = "", payload = raw, attempts = 0}
+	end
+	msg.attempts = (tonumber(msg.attempts) or 0) + 1
+
+	if msg.attempts > tonumber(ARGV[1]) then
+		redis.call("RPUSH", KEYS[4], cjson.encode(msg))
+		return 1
+	end
+
+	redis.call("LPUSH", KEYS[3], cjson.encode(msg))
+	return 0
+end
+`
+
+// queueNackScript requeue message
+//
+// ARGV[2]: raw message
+//
+// return 0 if requeued, 1 if moved to dead-letter list,
+// -1 if message is not in processing list
+var queueNackScript = redis.NewScript(queueRequeueLua + `
+return requeue(ARGV[2])
+`)
+
+// queueReapScript requeue all messages exceeded visibility timeout in processing list
+//
+// KEYS[5]: consumers
+// ARGV[2]: visibility timeout in milliseconds
+// ARGV[3]: consumer id
+//
+// consumer is unregistered only if its processing list is empty
+// and it has not been alive for a while.
+//
+// return how many messages are requeued
+var queueReapScript = redis.NewScript(queueRequeueLua + `
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local n = 0
+for _, raw in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	local deadline = redis.call("ZSCORE", KEYS[2], raw)
+	if not deadline then
+		-- consumer crashed before registered deadline
+		redis.call("ZADD", KEYS[2], now + tonumber(ARGV[2]), raw)
+	elseif tonumber(deadline) <= now then
+		if requeue(raw) >= 0 then
+			n = n + 1
+		end
+	end
+end
+
+if redis.call("LLEN", KEYS[1]) == 0 then
+	local alive = redis.call("ZSCORE", KEYS[5], ARGV[3])
+	if not alive or tonumber(alive) <= now then
+		redis.call("ZREM", KEYS[5], ARGV[3])
+	end
+end
+return n
+`)
+
+// queueRecoverScript requeue all messages in processing list,
+// which are left by the previous run of the same consumer
+//
+// return how many messages are requeued
+var queueRecoverScript = redis.NewScript(queueRequeueLua + `
+local n = 0
+for _, raw in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	if requeue(raw) >= 0 then
+		n = n + 1
+	end
+end
+return n
+`)
+
+// QueueMessage message delivered by `Queue.Dequeue`
+type QueueMessage struct {
+	// ID unique id of message
+	ID string `json:"id"`
+	// Payload content of message
+	Payload string `json:"payload"`
+	// Attempts how many times this message has failed before
+	Attempts int `json:"attempts"`
+
+	// raw encoded message in redis
+	raw string
+}
+
+// Queue reliable work queue with acknowledgements
+//
+// Redis keys:
+//
+//	`/rtils/queue/{<queue_name>}/`
+//
+//	* ready: list of messages waiting for delivery, pushed at left and popped at right
+//	* processing/<consumer_id>: list of messages delivered to consumer
+//	* deadlines: raw message -> visibility deadline
+//	* consumers: consumer id -> alive deadline, consumers who may have processing messages
+//	* dead: list of messages exceeded retry limit
+//
+// Implementations:
+//
+//  1. enqueue: `LPUSH` message to `ready`
+//  2. dequeue: register consumer to `consumers` before delivering,
+//     `BLMOVE` message from `ready` to consumer's `processing`,
+//     or `BRPOPLPUSH` if redis < 6.2,
+//     then register its visibility deadline to `deadlines`.
+//     messages left in consumer's `processing` by its previous run
+//     are requeued on its first dequeue.
+//  3. ack: delete message from `processing` and `deadlines`
+//  4. nack: delete message from `processing` and `deadlines`,
+//     increase its attempts, then push back to the tail of `ready`,
+//     or to `dead` if attempts exceeds retry limit
+//  5. reaper: nack all messages exceeded visibility deadline in all consumers' `processing`,
+//     consumer is unregistered once its `processing` is empty and it is not alive
+//
+// messages are delivered at least once.
+type Queue interface {
+	// Enqueue push messages to queue
+	Enqueue(ctx context.Context, payloads ...string) error
+	// Dequeue block until got a message or ctx done,
+	// message should be acked or nacked before visibility timeout,
+	// otherwise it will be redelivered.
+	//
+	// the first dequeue requeues messages left by the previous run of the same consumer id.
+	Dequeue(ctx context.Context) (*QueueMessage, error)
+	// Ack mark message as done
+	//
+	// return ErrNotAcquired if message is not held by this consumer,
+	// e.g. it is acked already or requeued after visibility timeout
+	Ack(ctx context.Context, msg *QueueMessage) error
+	// Nack mark message as failed, message will be redelivered,
+	// or moved to dead-letter list if exceeded retry limit
+	//
+	// return ErrNotAcquired if message is not held by this consumer
+	Nack(ctx context.Context, msg *QueueMessage) error
+	// Reap requeue messages exceeded visibility timeout once,
+	// return how many messages are requeued
+	Reap(ctx context.Context) (int, error)
+	// RunReaper reap messages every reap interval, block until ctx done
+	RunReaper(ctx context.Context)
+}
+
+type queueOption struct {
+	consumerID        string
+	visibilityTimeout time.Duration
+	maxRetries        int
+	reapInterval      time.Duration
+	blockTimeout      time.Duration
+}
+
+type queue struct {
+	queueOption
+	rdb    *Utils
+	logger gutils.LoggerItf
+
+	name,
+	ready,
+	processing,
+	deadlines,
+	consumers,
+	dead string
+
+	recoverMu sync.Mutex
+	// recovered whether messages left by previous run have been requeued
+	recovered bool
+}
+
+// QueueOptionFunc options for queue
+type QueueOptionFunc func(*queue) error
+
+// WithQueueConsumerID set consumer id,
+// should be unique and stable between restarts,
+// will auto generate by UUID4 if not set
+func WithQueueConsumerID(consumerID string) QueueOptionFunc {
+	return func(q *queue) error {
+		if consumerID == "" {
+			return errors.Wrap(ErrInvalidArgument, "consumer id must not be empty")
+		}
+
+		q.consumerID = consumerID
+		return nil
+	}
+}
+
+// WithQueueVisibilityTimeout set how long a delivered message could be unacked
+// before being redelivered
+func WithQueueVisibilityTimeout(timeout time.Duration) QueueOptionFunc {
+	return func(q *queue) error {
+		if timeout < time.Millisecond {
+			return errors.Wrap(ErrInvalidArgument, "visibility timeout must not less than 1ms")
+		}
+
+		q.visibilityTimeout = timeout
+		return nil
+	}
+}
+
+// WithQueueMaxRetries set how many times a failed message could be redelivered,
+// message will be moved to dead-letter list if exceeded
+func WithQueueMaxRetries(maxRetries int) QueueOptionFunc {
+	return func(q *queue) error {
+		if maxRetries < 0 {
+			return errors.Wrap(ErrInvalidArgument, "max retries must not less than 0")
+		}
+
+		q.maxRetries = maxRetries
+		return nil
+	}
+}
+
+// WithQueueReapInterval set interval of reaper
+func WithQueueReapInterval(interval time.Duration) QueueOptionFunc {
+	return func(q *queue) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "reap interval must greater than 0")
+		}
+
+		q.reapInterval = interval
+		return nil
+	}
+}
+
+// WithQueueBlockTimeout set timeout of each `BLMOVE` or `BRPOPLPUSH`,
+// ctx is checked between each blocking call
+func WithQueueBlockTimeout(timeout time.Duration) QueueOptionFunc {
+	return func(q *queue) error {
+		if timeout <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "block timeout must greater than 0")
+		}
+
+		q.blockTimeout = timeout
+		return nil
+	}
+}
+
+// WithQueueLogger set queue's logger
+func WithQueueLogger(logger *gutils.LoggerType) QueueOptionFunc {
+	return func(q *queue) error {
+		q.logger = logger
+		return nil
+	}
+}
+
+// NewQueue new reliable work queue
+func (u *Utils) NewQueue(name string, opts ...QueueOptionFunc) (Queue, error) {
+	q := &queue{
+		rdb:       u,
+		logger:    u.logger,
+		name:      name,
+		ready:     u.buildKey(defaultKeyQueueReady, name),
+		deadlines: u.buildKey(defaultKeyQueueDeadlines, name),
+		consumers: u.buildKey(defaultKeyQueueConsumers, name),
+		dead:      u.buildKey(defaultKeyQueueDead, name),
+		queueOption: queueOption{
+			consumerID:        uuid.New().String(),
+			visibilityTimeout: defaultQueueVisibilityTimeout,
+			maxRetries:        defaultQueueMaxRetries,
+			reapInterval:      defaultQueueReapInterval,
+			blockTimeout:      defaultQueueBlockTimeout,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(q); err != nil {
+			return nil, err
+		}
+	}
+
+	q.processing = q.processingKey(q.consumerID)
+	return q, nil
+}
+
+func (q *queue) processingKey(consumerID string) string {
+	return q.rdb.buildKey(defaultKeyQueueProcessing, q.name, consumerID)
+}
+
+// Enqueue push messages to queue
+func (q *queue) Enqueue(ctx context.Context, payloads ...string) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	msgs := make([]interface{}, 0, len(payloads))
+	for _, payload := range payloads {
+		raw, err := json.Marshal(&QueueMessage{
+			ID:      uuid.New().String(),
+			Payload: payload,
+		})
+		if err != nil {
+			return errors.Wrap(err, "marshal message")
+		}
+
+		msgs = append(msgs, string(raw))
+	}
+
+	if err := q.rdb.UniversalClient.LPush(ctx, q.ready, msgs...).Err(); err != nil {
+		return errors.Wrapf(err, "lpush `%s`", q.ready)
+	}
+
+	return nil
+}
+
+// aliveTimeout how long consumer is considered alive after registered,
+// covers a whole blocking move (at least 1s) and the following visibility timeout
+func (q *queue) aliveTimeout() time.Duration {
+	block := q.blockTimeout
+	if block < time.Second {
+		block = time.Second
+	}
+
+	return block + q.visibilityTimeout
+}
+
+// recover requeue messages left in processing list by previous run of this consumer
+func (q *queue) recover(ctx context.Context) error {
+	q.recoverMu.Lock()
+	defer q.recoverMu.Unlock()
+	if q.recovered {
+		return nil
+	}
+
+	n, err := queueRecoverScript.Run(ctx, q.rdb,
+		[]string{q.processing, q.deadlines, q.ready, q.dead},
+		q.maxRetries,
+	).Int()
+	if err != nil {
+		return errors.Wrapf(err, "recover `%s`", q.processing)
+	}
+
+	if n > 0 {
+		q.logger.Info("requeue messages left by previous run",
+			zap.String("queue", q.name), zap.String("consumer", q.consumerID), zap.Int("n", n))
+	}
+
+	q.recovered = true
+	return nil
+}
+
+// Dequeue block until got a message or ctx done
+func (q *queue) Dequeue(ctx context.Context) (*QueueMessage, error) {
+	if err := q.recover(ctx); err != nil {
+		return nil, err
+	}
+
+	blmove := q.rdb.supports(ctx, capBLMove)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "dequeue `%s`", q.ready)
+		default:
+		}
+
+		// consumer must be registered before message is moved to its processing list,
+		// otherwise message could not be found by reaper if consumer crashed
+		if err := queueDeadlineScript.Run(ctx, q.rdb,
+			[]string{q.consumers}, q.consumerID, q.aliveTimeout().Milliseconds(),
+		).Err(); err != nil {
+			return nil, errors.Wrapf(err, "register consumer `%s`", q.consumerID)
+		}
+
+		raw, err := q.move(ctx, blmove)
+		if err != nil {
+			if IsNil(err) {
+				continue
+			}
+
+			return nil, errors.Wrapf(err, "move message from `%s`", q.ready)
+		}
+
+		if err = queueDeadlineScript.Run(ctx, q.rdb,
+			[]string{q.deadlines},
+			raw, q.visibilityTimeout.Milliseconds(),
+		).Err(); err != nil {
+			// message will be requeued by reaper
+			return nil, errors.Wrapf(err, "register deadline of message in `%s`", q.processing)
+		}
+
+		msg := new(QueueMessage)
+		if err = json.Unmarshal([]byte(raw), msg); err != nil {
+			q.logger.Warn("unknown message format", zap.String("queue", q.name), zap.Error(err))
+			msg = &QueueMessage{Payload: raw}
+		}
+
+		msg.raw = raw
+		return msg, nil
+	}
+}
+
+// move block until move a message from ready list to processing list,
+// return redis.Nil if timeout
+func (q *queue) move(ctx context.Context, blmove bool) (string, error) {
+	if blmove {
+		return q.rdb.BLMove(ctx, q.ready, q.processing, "RIGHT", "LEFT", q.blockTimeout).Result()
+	}
+
+	return q.rdb.BRPopLPush(ctx, q.ready, q.processing, q.blockTimeout).Result()
+}
+
+// Ack mark message as done
+func (q *queue) Ack(ctx context.Context, msg *QueueMessage) error {
+	deleted, err := queueAckScript.Run(ctx, q.rdb,
+		[]string{q.processing, q.deadlines}, msg.raw).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "ack message `%s`", msg.ID)
+	}
+
+	if deleted == 0 {
+		return errors.Wrapf(ErrNotAcquired, "message `%s` not in processing list, may be redelivered", msg.ID)
+	}
+
+	return nil
+}
+
+// Nack mark message as failed
+func (q *queue) Nack(ctx context.Context, msg *QueueMessage) error {
+	ret, err := queueNackScript.Run(ctx, q.rdb,
+		[]string{q.processing, q.deadlines, q.ready, q.dead},
+		q.maxRetries, msg.raw,
+	).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "nack message `%s`", msg.ID)
+	}
+
+	switch ret {
+	case -1:
+		return errors.Wrapf(ErrNotAcquired, "message `%s` not in processing list, may be redelivered", msg.ID)
+	case 1:
+		q.logger.Warn("message exceeded retry limit, move to dead-letter list",
+			zap.String("queue", q.name), zap.String("id", msg.ID))
+	}
+
+	return nil
+}
+
+// Reap requeue messages exceeded visibility timeout once
+func (q *queue) Reap(ctx context.Context) (int, error) {
+	consumers, err := q.rdb.ZRange(ctx, q.consumers, 0, -1).Result()
+	if err != nil {
+		return 0, errors.Wrapf(err, "get consumers `%s`", q.consumers)
+	}
+
+	var total int
+	for _, consumerID := range consumers {
+		n, err := queueReapScript.Run(ctx, q.rdb,
+			[]string{q.processingKey(consumerID), q.deadlines, q.ready, q.dead, q.consumers},
+			q.maxRetries, q.visibilityTimeout.Milliseconds(), consumerID,
+		).Int()
+		if err != nil {
+			return total, errors.Wrapf(err, "reap consumer `%s`", consumerID)
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+// RunReaper reap messages every reap interval, block until ctx done
+func (q *queue) RunReaper(ctx context.Context) {
+	ticker := time.NewTicker(q.reapInterval)
+	defer ticker.Stop()
+
+	logger := q.logger.With(zap.String("queue", q.name))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := q.Reap(ctx)
+		if err != nil {
+			logger.Warn("reap queue", zap.Error(err))
+			continue
+		}
+
+		if n > 0 {
+			logger.Info("requeue timeout messages", zap.Int("n", n))
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewQueue(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := "laisky" + gutils.RandomStringWithLength(10)
+	q, err := rtils.NewQueue(name, WithQueueMaxRetries(1))
+	require.NoError(t, err)
+
+	require.NoError(t, q.Enqueue(ctx, "a", "b"))
+
+	// ack
+	msg, err := q.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", msg.Payload)
+	require.Equal(t, 0, msg.Attempts)
+	require.NoError(t, q.Ack(ctx, msg))
+	require.ErrorIs(t, q.Ack(ctx, msg), ErrNotAcquired)
+	require.ErrorIs(t, q.Nack(ctx, msg), ErrNotAcquired)
+
+	// nack, then redelivered
+	msg, err = q.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "b", msg.Payload)
+	require.NoError(t, q.Nack(ctx, msg))
+
+	msg, err = q.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "b", msg.Payload)
+	require.Equal(t, 1, msg.Attempts)
+
+	// exceeded retry limit
+	require.NoError(t, q.Nack(ctx, msg))
+	dead, err := rdb.LRange(ctx, q.(*queue).dead, 0, -1).Result()
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+
+	// empty queue
+	ctxTimeout, cancelTimeout := context.WithTimeout(ctx, 1500*time.Millisecond)
+	defer cancelTimeout()
+	_, err = q.Dequeue(ctxTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// invalid options
+	_, err = rtils.NewQueue(name, WithQueueReapInterval(0))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewQueue(name, WithQueueBlockTimeout(-time.Second))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewQueue(name, WithQueueConsumerID(""))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewQueue(name, WithQueueVisibilityTimeout(0))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewQueue(name, WithQueueMaxRetries(-1))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+// cmdNamesHook record names of processed commands
+type cmdNamesHook struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (h *cmdNamesHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.names = append(h.names, cmd.Name())
+	return ctx, nil
+}
+
+func (h *cmdNamesHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *cmdNamesHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *cmdNamesHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestUtils_NewQueue_move(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, c := range []struct {
+		version []int
+		cmd     string
+	}{
+		{[]int{6, 0, 0}, "brpoplpush"},
+		{[]int{6, 2, 0}, "blmove"},
+	} {
+		rdb := redis.NewClient(&redis.Options{})
+		hook := new(cmdNamesHook)
+		rdb.AddHook(hook)
+		rtils := NewRedisUtils(rdb)
+		rtils.version = c.version
+
+		// requeued message is delivered after existing messages
+		q, err := rtils.NewQueue("laisky" + gutils.RandomStringWithLength(10))
+		require.NoError(t, err)
+		require.NoError(t, q.Enqueue(ctx, "a", "b"))
+		msg, err := q.Dequeue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "a", msg.Payload)
+		require.NoError(t, q.Nack(ctx, msg))
+
+		for _, payload := range []string{"b", "a"} {
+			msg, err = q.Dequeue(ctx)
+			require.NoError(t, err)
+			require.Equal(t, payload, msg.Payload)
+			require.NoError(t, q.Ack(ctx, msg))
+		}
+
+		hook.mu.Lock()
+		require.Contains(t, hook.names, c.cmd, c.version)
+		hook.mu.Unlock()
+	}
+}
+
+func TestUtils_NewQueue_reaper(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := "laisky" + gutils.RandomStringWithLength(10)
+	crashed, err := rtils.NewQueue(name, WithQueueVisibilityTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	consumer, err := rtils.NewQueue(name,
+		WithQueueVisibilityTimeout(100*time.Millisecond),
+		WithQueueReapInterval(50*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, crashed.Enqueue(ctx, "a"))
+	msg, err := crashed.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", msg.Payload)
+
+	// not timeout yet
+	n, err := consumer.Reap(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	go consumer.RunReaper(ctx)
+	msg, err = consumer.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", msg.Payload)
+	require.Equal(t, 1, msg.Attempts)
+	require.NoError(t, consumer.Ack(ctx, msg))
+}
+
+// failScriptHook fail lua scripts on the specified key when enabled
+type failScriptHook struct {
+	key     string
+	enabled int32
+}
+
+func (h *failScriptHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	args := cmd.Args()
+	if atomic.LoadInt32(&h.enabled) == 1 &&
+		len(args) > 3 && args[0] == "evalsha" && args[3] == h.key {
+		return ctx, errors.New("consumer crashed")
+	}
+
+	return ctx, nil
+}
+
+func (h *failScriptHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *failScriptHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failScriptHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestUtils_NewQueue_crashBeforeTouch(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	crashedRdb := redis.NewClient(&redis.Options{})
+	hook := new(failScriptHook)
+	crashedRdb.AddHook(hook)
+	crashedRtils := NewRedisUtils(crashedRdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := "laisky" + gutils.RandomStringWithLength(10)
+	crashedID := "crashed" + gutils.RandomStringWithLength(10)
+	crashed, err := crashedRtils.NewQueue(name,
+		WithQueueConsumerID(crashedID),
+		WithQueueVisibilityTimeout(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	consumer, err := rtils.NewQueue(name,
+		WithQueueVisibilityTimeout(100*time.Millisecond),
+		WithQueueReapInterval(50*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	// crashed after message is moved to processing list, before deadline is registered
+	require.NoError(t, crashed.Enqueue(ctx, "a"))
+	hook.key = crashed.(*queue).deadlines
+	atomic.StoreInt32(&hook.enabled, 1)
+	_, err = crashed.Dequeue(ctx)
+	require.Error(t, err)
+
+	processing, err := rdb.LRange(ctx, crashed.(*queue).processing, 0, -1).Result()
+	require.NoError(t, err)
+	require.Len(t, processing, 1)
+
+	// consumer with empty processing list is not unregistered while it is alive
+	_, err = consumer.Reap(ctx)
+	require.NoError(t, err)
+	consumers, err := rdb.ZRange(ctx, crashed.(*queue).consumers, 0, -1).Result()
+	require.NoError(t, err)
+	require.Contains(t, consumers, crashedID)
+
+	go consumer.RunReaper(ctx)
+	msg, err := consumer.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", msg.Payload)
+	require.Equal(t, 1, msg.Attempts)
+	require.NoError(t, consumer.Ack(ctx, msg))
+}
+
+func TestUtils_NewQueue_recover(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := "laisky" + gutils.RandomStringWithLength(10)
+	consumerID := "consumer" + gutils.RandomStringWithLength(10)
+	q, err := rtils.NewQueue(name, WithQueueConsumerID(consumerID))
+	require.NoError(t, err)
+
+	require.NoError(t, q.Enqueue(ctx, "a"))
+	msg, err := q.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", msg.Payload)
+
+	// restarted before ack, message is requeued immediately
+	restarted, err := rtils.NewQueue(name, WithQueueConsumerID(consumerID))
+	require.NoError(t, err)
+	msg, err = restarted.Dequeue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", msg.Payload)
+	require.Equal(t, 1, msg.Attempts)
+	require.NoError(t, restarted.Ack(ctx, msg))
+}
@@ -2,7 +2,6 @@ package redis
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/Laisky/zap"
 	"github.com/go-redis/redis/v8"
@@ -16,7 +15,8 @@ import (
 // and then the user's key, score, and snapshot ID are stored
 // in the ordered set. member is the key, score is the (score * 100000 + snapshot ID).
 type Rank interface {
-	// Set set/update someone's score and snapshotID
+	// Set set/update someone's score and snapshotID,
+	// return ErrInvalidSnapshotID if snapshotID is out of range
 	Set(ctx context.Context, key string, score, snapshotID int) error
 	// Del delete a key
 	Del(ctx context.Context, key string) error
@@ -35,16 +35,16 @@ type rank struct {
 // NewRank create a new rank
 func (u *Utils) NewRank(name string, maxSnapshotID int) (Rank, error) {
 	if maxSnapshotID <= 0 {
-		return nil, errors.Errorf("maxSnapshotID must greater than 0")
+		return nil, errors.Wrap(ErrInvalidSnapshotID, "maxSnapshotID must greater than 0")
 	}
 
 	if maxSnapshotID%10 != 0 {
-		return nil, errors.Errorf("maxSnapshotID must be multiple of 10")
+		return nil, errors.Wrap(ErrInvalidSnapshotID, "maxSnapshotID must be multiple of 10")
 	}
 
 	return &rank{
 		rdb:           u,
-		dataKey:       fmt.Sprintf(defaultKeyRankData, name),
+		dataKey:       u.buildKey(defaultKeyRankData, name),
 		maxSnapshotID: maxSnapshotID,
 	}, nil
 }
@@ -52,10 +52,10 @@ func (u *Utils) NewRank(name string, maxSnapshotID int) (Rank, error) {
 // Set set/update someone's score and snapshotID
 func (r *rank) Set(ctx context.Context, key string, score, snapshotID int) error {
 	if key == "" {
-		return errors.Errorf("key must not be empty")
+		return errors.Wrap(ErrInvalidArgument, "key must not be empty")
 	}
-	if snapshotID >= r.maxSnapshotID {
-		return errors.Errorf("ver's length must shorter than %d", r.maxSnapshotID)
+	if snapshotID < 0 || snapshotID >= r.maxSnapshotID {
+		return errors.Wrapf(ErrInvalidSnapshotID, "snapshotID must in [0, %d)", r.maxSnapshotID)
 	}
 
 	v := score*r.maxSnapshotID + snapshotID
@@ -63,7 +63,7 @@ func (r *rank) Set(ctx context.Context, key string, score, snapshotID int) error
 		return errors.Wrapf(err, "zadd %s.%s", r.dataKey, key)
 	}
 
-	logger.Debug("set rank", zap.String("key", r.dataKey),
+	r.rdb.logger.Debug("set rank", zap.String("key", r.dataKey),
 		zap.String("member", key),
 		zap.Int("score", score),
 		zap.Int("ver", snapshotID))
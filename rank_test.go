@@ -40,19 +40,20 @@ func TestUtils_NewRank(t *testing.T) {
 	defer cancel()
 
 	_, err := rtils.NewRank("test", 0)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidSnapshotID)
 	_, err = rtils.NewRank("test", -2)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidSnapshotID)
 	_, err = rtils.NewRank("test", 11)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidSnapshotID)
 
 	r, err := rtils.NewRank("laisky", 10000)
 	require.NoError(t, err)
 
 	t.Run("getset", func(t *testing.T) {
-		require.Error(t, r.Set(ctx, "", 0, 0))
-		require.Error(t, r.Set(ctx, "123", 0, 10000))
-		require.Error(t, r.Set(ctx, "123", 0, 10001))
+		require.ErrorIs(t, r.Set(ctx, "", 0, 0), ErrInvalidArgument)
+		require.ErrorIs(t, r.Set(ctx, "123", 0, 10000), ErrInvalidSnapshotID)
+		require.ErrorIs(t, r.Set(ctx, "123", 0, 10001), ErrInvalidSnapshotID)
+		require.ErrorIs(t, r.Set(ctx, "123", 0, -1), ErrInvalidSnapshotID)
 		require.NoError(t, r.Set(ctx, "1", 1, 1))
 		ret, err := r.Get(ctx, "1")
 		require.NoError(t, err)
@@ -0,0 +1,378 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// RateLimiterAlgorithm algorithm of rate limiter
+type RateLimiterAlgorithm string
+
+const (
+	// RateLimiterTokenBucket token bucket,
+	// bucket holds at most `burst` tokens, refilled at `limit/period`
+	RateLimiterTokenBucket RateLimiterAlgorithm = "token_bucket"
+	// RateLimiterSlidingWindow sliding window log,
+	// at most `limit` events in any window of `period`, burst is ignored
+	RateLimiterSlidingWindow RateLimiterAlgorithm = "sliding_window"
+	// RateLimiterGCRA generic cell rate algorithm,
+	// events are emitted every `period/limit`, allow `burst` events at once
+	RateLimiterGCRA RateLimiterAlgorithm = "gcra"
+)
+
+const (
+	defaultRateLimiterAlgorithm = RateLimiterTokenBucket
+	defaultRateLimiterLimit     = 10
+	defaultRateLimiterPeriod    = time.Second
+)
+
+// rate limiter scripts share the same arguments and return value:
+//
+// KEYS[1]: state key
+// ARGV[1]: limit, events per period
+// ARGV[2]: period in milliseconds
+// ARGV[3]: burst
+// ARGV[4]: n, events to acquire
+// ARGV[5]: "1" to reserve, events will be acquired even if caller should wait
+// ARGV[6]: unique id of this request
+//
+// return {allowed, wait}:
+//   - allowed: 1 if events are acquired (or reserved), otherwise 0
+//   - wait: milliseconds to wait before events are available,
+//     -1 if n exceeds the capacity of limiter
+//
+// use redis server's time, so limiters in different processes share the same clock.
+
+// rateLimiterTokenBucketScript token bucket
+//
+// KEYS[1]: hash of tokens & ts
+var rateLimiterTokenBucketScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local rate = tonumber(ARGV[1]) / tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+if n > burst then
+	return {0, -1}
+end
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed, wait = 0, 0
+if tokens >= n then
+	allowed = 1
+else
+	wait = math.ceil((n - tokens) / rate)
+	if ARGV[5] == "1" then
+		allowed = 1
+	end
+end
+
+if allowed == 1 then
+	tokens = tokens - n
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+return {allowed, wait}
+`)
+
+// rateLimiterSlidingWindowScript sliding window log
+//
+// KEYS[1]: zset of request_id -> timestamp
+var rateLimiterSlidingWindowScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[4])
+if n > limit then
+	return {0, -1}
+end
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+
+local allowed, wait = 0, 0
+if count + n <= limit then
+	allowed = 1
+else
+	-- wait until enough events slide out of the window
+	local oldest = redis.call("ZRANGE", KEYS[1], count + n - limit - 1, count + n - limit - 1, "WITHSCORES")
+	wait = math.max(0, tonumber(oldest[2]) + window - now)
+	if ARGV[5] == "1" then
+		allowed = 1
+	end
+end
+
+if allowed == 1 then
+	for i = 1, n do
+		redis.call("ZADD", KEYS[1], now + wait, ARGV[6] .. ":" .. i)
+	end
+end
+
+redis.call("PEXPIRE", KEYS[1], window + wait + 1)
+return {allowed, wait}
+`)
+
+// rateLimiterGCRAScript generic cell rate algorithm
+//
+// KEYS[1]: theoretical arrival time
+var rateLimiterGCRAScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local emission = tonumber(ARGV[2]) / tonumber(ARGV[1])
+local tolerance = emission * tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+if n * emission > tolerance then
+	return {0, -1}
+end
+
+local tat = math.max(tonumber(redis.call("GET", KEYS[1])) or now, now)
+local newTat = tat + n * emission
+local wait = math.max(0, math.ceil(newTat - tolerance - now))
+
+if wait > 0 and ARGV[5] ~= "1" then
+	return {0, wait}
+end
+
+redis.call("SET", KEYS[1], newTat, "PX", math.ceil(newTat - now) + 1)
+return {1, wait}
+`)
+
+// RateLimiter distributed rate limiter
+//
+// Redis keys:
+//
+//	`/rtils/sync/ratelimit/{<limiter_name>}/<algorithm>`
+//
+// Implementations:
+//
+// each algorithm is an atomic lua script, based on redis server's time.
+//
+//   - token bucket: hash of tokens & last refill time,
+//     refill tokens by elapsed time, then consume tokens
+//   - sliding window log: zset of all events in the window,
+//     delete expired events, then add new events if window is not full
+//   - GCRA: theoretical arrival time(TAT),
+//     allow if `TAT + n * emission - burst * emission <= now`, then move TAT forward
+type RateLimiter interface {
+	// Allow acquire one event, return false if rate limit exceeded
+	Allow(ctx context.Context) (bool, error)
+	// AllowN acquire n events at once, return false if rate limit exceeded
+	AllowN(ctx context.Context, n int) (bool, error)
+	// Wait block until one event is acquired or ctx done
+	Wait(ctx context.Context) error
+	// Reserve reserve one event, caller should wait `Reservation.Delay()`
+	// before acting
+	Reserve(ctx context.Context) (*Reservation, error)
+}
+
+// Reservation event reserved by `RateLimiter.Reserve`
+type Reservation struct {
+	ok    bool
+	delay time.Duration
+}
+
+// OK whether the event is reserved,
+// false means the event can never be acquired, e.g. n exceeds burst
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay how long caller should wait before acting
+func (r *Reservation) Delay() time.Duration {
+	return r.delay
+}
+
+type rateLimiterOption struct {
+	algorithm RateLimiterAlgorithm
+	limit     int
+	period    time.Duration
+	burst     int
+}
+
+type rateLimiter struct {
+	rateLimiterOption
+	rdb    *Utils
+	logger gutils.LoggerItf
+	name   string
+	key    string
+}
+
+// RateLimiterOptionFunc options for rate limiter
+type RateLimiterOptionFunc func(*rateLimiter) error
+
+// WithRateLimiterAlgorithm set algorithm of rate limiter
+func WithRateLimiterAlgorithm(algorithm RateLimiterAlgorithm) RateLimiterOptionFunc {
+	return func(rl *rateLimiter) error {
+		switch algorithm {
+		case RateLimiterTokenBucket, RateLimiterSlidingWindow, RateLimiterGCRA:
+		default:
+			return errors.Errorf("unknown algorithm `%s`", algorithm)
+		}
+
+		rl.algorithm = algorithm
+		return nil
+	}
+}
+
+// WithRateLimiterLimit set rate limit, allow limit events per period
+func WithRateLimiterLimit(limit int, period time.Duration) RateLimiterOptionFunc {
+	return func(rl *rateLimiter) error {
+		if limit <= 0 {
+			return errors.Errorf("limit must greater than 0")
+		}
+		if period < time.Millisecond {
+			return errors.Errorf("period must not less than 1ms")
+		}
+
+		rl.limit = limit
+		rl.period = period
+		return nil
+	}
+}
+
+// WithRateLimiterBurst set max events could be acquired at once,
+// default equals to limit
+func WithRateLimiterBurst(burst int) RateLimiterOptionFunc {
+	return func(rl *rateLimiter) error {
+		if burst <= 0 {
+			return errors.Errorf("burst must greater than 0")
+		}
+
+		rl.burst = burst
+		return nil
+	}
+}
+
+// WithRateLimiterLogger set rate limiter's logger
+func WithRateLimiterLogger(logger *gutils.LoggerType) RateLimiterOptionFunc {
+	return func(rl *rateLimiter) error {
+		rl.logger = logger
+		return nil
+	}
+}
+
+// NewRateLimiter new distributed rate limiter
+func (u *Utils) NewRateLimiter(name string, opts ...RateLimiterOptionFunc) (RateLimiter, error) {
+	rl := &rateLimiter{
+		rdb:    u,
+		logger: u.logger,
+		name:   name,
+		rateLimiterOption: rateLimiterOption{
+			algorithm: defaultRateLimiterAlgorithm,
+			limit:     defaultRateLimiterLimit,
+			period:    defaultRateLimiterPeriod,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(rl); err != nil {
+			return nil, err
+		}
+	}
+
+	if rl.burst == 0 {
+		rl.burst = rl.limit
+	}
+
+	rl.key = u.buildKey(defaultKeySyncRateLimiter, name, rl.algorithm)
+	return rl, nil
+}
+
+// run run algorithm's script once
+func (rl *rateLimiter) run(ctx context.Context, n int, reserve bool) (allowed bool, wait time.Duration, err error) {
+	if n <= 0 {
+		return false, 0, errors.Errorf("n must greater than 0")
+	}
+
+	defer func(start time.Time) {
+		rl.rdb.observe(ctx, "ratelimiter", rl.key, "allow", start, allowed, err)
+	}(time.Now())
+
+	var script *redis.Script
+	switch rl.algorithm {
+	case RateLimiterTokenBucket:
+		script = rateLimiterTokenBucketScript
+	case RateLimiterSlidingWindow:
+		script = rateLimiterSlidingWindowScript
+	case RateLimiterGCRA:
+		script = rateLimiterGCRAScript
+	}
+
+	ret, err := script.Run(ctx, rl.rdb, []string{rl.key},
+		rl.limit,
+		rl.period.Milliseconds(),
+		rl.burst,
+		n,
+		luaBool(reserve),
+		uuid.New().String(),
+	).Int64Slice()
+	if err != nil {
+		return false, 0, errors.Wrapf(err, "run rate limiter `%s`", rl.key)
+	}
+
+	return ret[0] == 1, time.Duration(ret[1]) * time.Millisecond, nil
+}
+
+// Allow acquire one event, return false if rate limit exceeded
+func (rl *rateLimiter) Allow(ctx context.Context) (bool, error) {
+	return rl.AllowN(ctx, 1)
+}
+
+// AllowN acquire n events at once, return false if rate limit exceeded
+func (rl *rateLimiter) AllowN(ctx context.Context, n int) (bool, error) {
+	allowed, _, err := rl.run(ctx, n, false)
+	return allowed, err
+}
+
+// Wait block until one event is acquired or ctx done
+func (rl *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		allowed, wait, err := rl.run(ctx, 1, false)
+		if err != nil {
+			return err
+		} else if allowed {
+			return nil
+		} else if wait < 0 {
+			return errors.Errorf("rate limiter `%s` can never be satisfied", rl.name)
+		}
+
+		rl.logger.Debug("rate limit exceeded, wait",
+			zap.String("limiter", rl.name), zap.Duration("wait", wait))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Reserve reserve one event, caller should wait `Reservation.Delay()`
+// before acting
+func (rl *rateLimiter) Reserve(ctx context.Context) (*Reservation, error) {
+	allowed, wait, err := rl.run(ctx, 1, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !allowed {
+		return &Reservation{}, nil
+	}
+
+	return &Reservation{ok: true, delay: wait}, nil
+}
@@ -0,0 +1,84 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewRateLimiter(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	_, err := rtils.NewRateLimiter("laisky", WithRateLimiterAlgorithm("unknown"))
+	require.Error(t, err)
+	_, err = rtils.NewRateLimiter("laisky", WithRateLimiterLimit(0, time.Second))
+	require.Error(t, err)
+	_, err = rtils.NewRateLimiter("laisky", WithRateLimiterBurst(-1))
+	require.Error(t, err)
+
+	for _, algorithm := range []RateLimiterAlgorithm{
+		RateLimiterTokenBucket,
+		RateLimiterSlidingWindow,
+		RateLimiterGCRA,
+	} {
+		algorithm := algorithm
+		t.Run(string(algorithm), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			name := "laisky" + gutils.RandomStringWithLength(10)
+			rl, err := rtils.NewRateLimiter(name,
+				WithRateLimiterAlgorithm(algorithm),
+				WithRateLimiterLimit(5, 500*time.Millisecond),
+			)
+			require.NoError(t, err)
+
+			// burst
+			for i := 0; i < 5; i++ {
+				allowed, err := rl.Allow(ctx)
+				require.NoError(t, err)
+				require.True(t, allowed, i)
+			}
+
+			allowed, err := rl.Allow(ctx)
+			require.NoError(t, err)
+			require.False(t, allowed)
+
+			// exceeds capacity
+			allowed, err = rl.AllowN(ctx, 6)
+			require.NoError(t, err)
+			require.False(t, allowed)
+
+			// wait
+			start := time.Now()
+			require.NoError(t, rl.Wait(ctx))
+			require.Greater(t, time.Since(start), 50*time.Millisecond)
+			require.Less(t, time.Since(start), time.Second)
+
+			// reserve
+			for {
+				allowed, err = rl.Allow(ctx)
+				require.NoError(t, err)
+				if !allowed {
+					break
+				}
+			}
+
+			r, err := rl.Reserve(ctx)
+			require.NoError(t, err)
+			require.True(t, r.OK())
+			require.Greater(t, r.Delay(), time.Duration(0))
+
+			// recover after period
+			time.Sleep(time.Second)
+			allowed, err = rl.AllowN(ctx, 5)
+			require.NoError(t, err)
+			require.True(t, allowed)
+		})
+	}
+}
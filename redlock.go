@@ -0,0 +1,453 @@
+package redis
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	// redlockClockDriftFactor clock drift factor of redis nodes
+	redlockClockDriftFactor = 0.01
+	// redlockClockDriftMin minimal clock drift of redis nodes
+	redlockClockDriftMin = 2 * time.Millisecond
+	// redlockNodeTimeoutFactor timeout of each node is `ttl * redlockNodeTimeoutFactor`
+	redlockNodeTimeoutFactor = 0.1
+)
+
+// redlockFenceScript raise fencing token counter to token
+//
+// KEYS[1]: fencing token counter
+// ARGV[1]: fencing token
+//
+// return 1 if counter is not less than token after raised
+var redlockFenceScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if current < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// redlock quorum mutex across multiple independent redis nodes
+//
+// Redis keys on each node, built by the key prefix and builder of the node:
+//
+//	`/rtils/sync/mutex/{<lock_id>}`: client_id
+//
+// Implementations, follow the Redlock algorithm:
+//
+//  1. generate client id(cid)
+//  2. try to acquire lock on all nodes in parallel,
+//     each node has a short timeout (`ttl * 0.1`) to skip unavailable nodes
+//  3. lock is acquired only if it is acquired on the majority of nodes,
+//     and the validity time `ttl - elapsed - drift` is still positive,
+//     drift is `ttl * 0.01 + 2ms`
+//  4. if failed to acquire lock, release it on nodes acquired by this attempt,
+//     then retry after a random delay.
+//     nodes failed to respond are released as well, unless the attempt is reentrant,
+//     since the lease of outer holder should not be decreased.
+//  5. if succeeded, auto refresh lock's ttl on all nodes,
+//     lockCtx will be set to done if the majority of nodes can not be refreshed
+//     within the validity time
+//  6. unlock: release lock on all nodes
+//
+// fencing token:
+//
+// counters on nodes are increased independently, so the largest one is not monotonic by itself.
+// after acquired on the majority of nodes, the largest token is written back
+// to the counters of these nodes, acquisition fails if it is not saved on the majority.
+// since any two majorities share at least one node, the next acquisition
+// always gets a larger token.
+type redlock struct {
+	*mutexOption
+	logger gutils.LoggerItf
+	nodes  []*mutex
+	quorum int
+	ctxs   lockCtxs
+}
+
+// NewRedlock new quorum mutex across multiple independent redis nodes.
+//
+// nodes should be independent redis masters, not replicas of each other.
+// share the same options as `NewMutex`.
+func NewRedlock(lockName string, nodes []*Utils, opts ...MutexOptionFunc) (Mutex, error) {
+	if len(nodes) == 0 {
+		return nil, errors.Errorf("nodes must not be empty")
+	}
+
+	tpl, err := nodes[0].NewMutex(lockName, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	first := tpl.(*mutex)
+	rl := &redlock{
+		mutexOption: first.mutexOption,
+		logger:      first.logger,
+		nodes:       []*mutex{first},
+		quorum:      len(nodes)/2 + 1,
+	}
+	// refresh grace is enlarged by clock drift
+	if rl.refreshGrace+rl.drift() >= rl.ttl {
+		return nil, errors.Wrapf(ErrInvalidArgument,
+			"refresh grace `%s` plus clock drift `%s` must less than ttl `%s`",
+			rl.refreshGrace, rl.drift(), rl.ttl)
+	}
+
+	for _, node := range nodes[1:] {
+		mu, err := node.NewMutex(lockName, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		// all nodes share the same options
+		nodeMu := mu.(*mutex)
+		nodeMu.mutexOption = first.mutexOption
+		nodeMu.logger = first.logger
+		rl.nodes = append(rl.nodes, nodeMu)
+	}
+
+	return rl, nil
+}
+
+// drift max clock drift between nodes
+func (r *redlock) drift() time.Duration {
+	return time.Duration(float64(r.ttl)*redlockClockDriftFactor) + redlockClockDriftMin
+}
+
+// forEachNode run fn on all nodes in parallel with per-node timeout,
+// return how many nodes succeed
+func (r *redlock) forEachNode(ctx context.Context,
+	fn func(ctx context.Context, node *mutex) (bool, error)) (succeed int) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		timeout = time.Duration(float64(r.ttl) * redlockNodeTimeoutFactor)
+	)
+	for _, node := range r.nodes {
+		wg.Add(1)
+		go func(node *mutex) {
+			defer wg.Done()
+			nodeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			ok, err := fn(nodeCtx, node)
+			if err != nil {
+				r.logger.Debug("redlock node", zap.String("dbkey", node.name), zap.Error(err))
+				return
+			}
+
+			if ok {
+				mu.Lock()
+				succeed++
+				mu.Unlock()
+			}
+		}(node)
+	}
+
+	wg.Wait()
+	return succeed
+}
+
+// releaseNodes release lock on specified nodes, ignore errors.
+//
+// do not use caller's ctx, partially acquired locks should be released
+// even if caller's ctx is done.
+func (r *redlock) releaseNodes(cid string, nodes map[*mutex]bool) {
+	r.forEachNode(context.Background(), func(ctx context.Context, node *mutex) (bool, error) {
+		if !nodes[node] {
+			return false, nil
+		}
+
+		remaining, err := node.release(ctx, cid)
+		return remaining >= 0, err
+	})
+}
+
+// sleep wait random delay to avoid split brain between competing clients
+func (r *redlock) sleep(ctx context.Context) {
+	delay := r.spinInterval/2 + time.Duration(rand.Int63n(int64(r.spinInterval)+1))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// wait acquire lock by cid on the majority of nodes, block until acquired if blocking,
+// return 0 token if lock is held by others and not blocking
+func (r *redlock) wait(ctx context.Context, cid string) (token, count int64, validUntil time.Time, err error) {
+	// outer holder's lease on nodes should not be released by failed reentrant attempt
+	reentrant := cid == r.clientID && r.ctxs.held()
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, 0, validUntil, ctx.Err()
+		default:
+		}
+
+		var (
+			mu       sync.Mutex
+			start    = time.Now()
+			acquired = map[*mutex]bool{}
+			// unknown nodes may be acquired, but failed to respond
+			unknown = map[*mutex]bool{}
+		)
+		token, count = 0, 0
+		n := r.forEachNode(ctx, func(ctx context.Context, node *mutex) (bool, error) {
+			nodeToken, nodeCount, err := node.acquire(ctx, cid)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				unknown[node] = true
+				return false, err
+			}
+
+			if nodeToken > token {
+				token = nodeToken
+			}
+			if nodeCount > count {
+				count = nodeCount
+			}
+			if nodeToken != 0 {
+				acquired[node] = true
+			}
+
+			return nodeToken != 0, nil
+		})
+
+		saved := 0
+		if n >= r.quorum {
+			saved = r.saveFence(ctx, acquired, token)
+		}
+
+		validity := r.ttl - time.Since(start) - r.drift()
+		if saved >= r.quorum && validity > 0 {
+			return token, count, start.Add(validity), nil
+		}
+
+		r.logger.Debug("failed to acquire redlock",
+			zap.String("dbkey", r.nodes[0].name),
+			zap.Int("acquired", n),
+			zap.Int("fenced", saved),
+			zap.Duration("validity", validity))
+		if !reentrant {
+			for node := range unknown {
+				acquired[node] = true
+			}
+		}
+		r.releaseNodes(cid, acquired)
+		if !r.blocking {
+			return 0, 0, validUntil, nil
+		}
+
+		r.sleep(ctx)
+	}
+}
+
+// saveFence raise fencing token counters of acquired nodes to token,
+// return how many nodes succeed
+func (r *redlock) saveFence(ctx context.Context, acquired map[*mutex]bool, token int64) int {
+	return r.forEachNode(ctx, func(ctx context.Context, node *mutex) (bool, error) {
+		if !acquired[node] {
+			return false, nil
+		}
+
+		if err := redlockFenceScript.Run(ctx, node.rdb, []string{node.fence}, token).Err(); err != nil {
+			return false, errors.Wrapf(err, "save fencing token to `%s`", node.fence)
+		}
+
+		return true, nil
+	})
+}
+
+// Lock acquire a recursive lock on the majority of nodes
+//
+// if succeed acquired lock,
+//   - locked == true
+//   - lockCtx is context of lock, this context will be set to done when lock is expired
+func (r *redlock) Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error) {
+	defer func(start time.Time) {
+		r.nodes[0].rdb.observe(ctx, "redlock", r.nodes[0].name, "lock", start, locked, err)
+	}(time.Now())
+
+	token, count, validUntil, err := r.wait(ctx, r.clientID)
+	if err != nil {
+		return false, nil, err
+	} else if token == 0 {
+		return false, nil, errors.Wrapf(ErrLockTaken, "redlock `%s`", r.nodes[0].name)
+	}
+
+	lockCtx, lease := r.ctxs.acquired(ctx, count, r.onLost)
+	if lease != nil {
+		go r.refreshLock(lease, r.clientID, validUntil)
+	}
+
+	return true, context.WithValue(lockCtx, fencingTokenCtxKey{}, token), nil
+}
+
+// refreshLock keep lock held by cid alive on the majority of nodes until lease is ended.
+//
+// refresh grace is enlarged by clock drift, so lock is considered lost
+// once the validity time since the last succeed refreshing is passed.
+func (r *redlock) refreshLock(lease *lockLease, cid string, validUntil time.Time) {
+	opt := *r.mutexOption
+	opt.refreshGrace += r.drift()
+	keepAliveUntil(lease, &opt, validUntil, r.logger.With(zap.String("dbkey", r.nodes[0].name)),
+		func(ctx context.Context) (bool, error) {
+			return r.extend(ctx, cid)
+		},
+		func(ctx context.Context) error {
+			return ErrLockExpired
+		},
+	)
+}
+
+// extend refresh lock held by cid on all nodes,
+// return false if lock is not held on the majority of nodes anymore,
+// return error if the majority could not be refreshed within the validity time
+// but may still be held.
+func (r *redlock) extend(ctx context.Context, cid string) (bool, error) {
+	var (
+		mu    sync.Mutex
+		errs  []error
+		start = time.Now()
+	)
+	n := r.forEachNode(ctx, func(ctx context.Context, node *mutex) (bool, error) {
+		ok, err := node.extend(ctx, cid)
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+
+		return ok, err
+	})
+
+	switch {
+	case n >= r.quorum && r.ttl-time.Since(start)-r.drift() > 0:
+		return true, nil
+	case n+len(errs) < r.quorum:
+		return false, nil
+	case len(errs) != 0:
+		return false, errors.Wrapf(errs[0], "renew redlock on %d/%d nodes", n, len(r.nodes))
+	default:
+		return false, errors.Errorf("renew redlock `%s` exceeded validity time", r.nodes[0].name)
+	}
+}
+
+// release release lock by cid on all nodes,
+// return the largest remaining count and how many nodes held the lock
+func (r *redlock) release(ctx context.Context, cid string) (remaining int64, held int, err error) {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	held = r.forEachNode(ctx, func(ctx context.Context, node *mutex) (bool, error) {
+		nodeRemaining, err := node.release(ctx, cid)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+			return false, err
+		}
+
+		if nodeRemaining > remaining {
+			remaining = nodeRemaining
+		}
+
+		return nodeRemaining >= 0, nil
+	})
+
+	if len(r.nodes)-len(errs) < r.quorum {
+		return remaining, held, errors.Wrapf(errs[0], "release redlock on %d/%d nodes failed",
+			len(errs), len(r.nodes))
+	}
+
+	return remaining, held, nil
+}
+
+// Unlock release lock on all nodes
+//
+// lock will be released after the outermost Unlock.
+func (r *redlock) Unlock(ctx context.Context) (err error) {
+	defer func(start time.Time) {
+		r.nodes[0].rdb.observe(ctx, "redlock", r.nodes[0].name, "unlock", start, err == nil, err)
+	}(time.Now())
+
+	remaining, held, err := r.release(ctx, r.clientID)
+	if held == 0 {
+		// local lease is kept if no node could be reached
+		if err == nil {
+			err = ErrLockNotHeld
+		}
+
+		return err
+	}
+
+	r.ctxs.released(remaining)
+	return err
+}
+
+// Acquire acquire a new non-reentrant lock on the majority of nodes, return its handle
+func (r *redlock) Acquire(ctx context.Context) (handle LockHandle, err error) {
+	defer func(start time.Time) {
+		r.nodes[0].rdb.observe(ctx, "redlock", r.nodes[0].name, "acquire", start, err == nil, err)
+	}(time.Now())
+
+	cid := newHandleClientID(r.clientID)
+	token, _, validUntil, err := r.wait(ctx, cid)
+	if err != nil {
+		return nil, err
+	} else if token == 0 {
+		return nil, errors.Wrapf(ErrLockTaken, "redlock `%s`", r.nodes[0].name)
+	}
+
+	lease := newLockLease(ctx, r.onLost)
+	go r.refreshLock(lease, cid, validUntil)
+
+	return &lockHandle{
+		cid:   cid,
+		ctx:   context.WithValue(lease.ctx, fencingTokenCtxKey{}, token),
+		lease: lease,
+		extend: func(ctx context.Context) (bool, error) {
+			return r.extend(ctx, cid)
+		},
+		release: func(ctx context.Context) (bool, error) {
+			_, held, err := r.release(ctx, cid)
+			return held > 0, err
+		},
+		ttl: func(ctx context.Context) (time.Duration, bool, error) {
+			var (
+				mu   sync.Mutex
+				ttls []time.Duration
+			)
+			r.forEachNode(ctx, func(ctx context.Context, node *mutex) (bool, error) {
+				ttl, ok, err := node.ttlOf(ctx, cid)
+				if ok {
+					mu.Lock()
+					ttls = append(ttls, ttl)
+					mu.Unlock()
+				}
+
+				return ok, err
+			})
+			if len(ttls) < r.quorum {
+				return 0, false, nil
+			}
+
+			// lock is valid until the quorum-th longest ttl is expired
+			sort.Slice(ttls, func(i, j int) bool { return ttls[i] > ttls[j] })
+			return ttls[r.quorum-1], true, nil
+		},
+	}, nil
+}
@@ -0,0 +1,298 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newRedlockNodes(t *testing.T, n int) (nodes []*Utils) {
+	for i := 0; i < n; i++ {
+		node := NewRedisUtils(redis.NewClient(&redis.Options{DB: i}))
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func TestNewRedlock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := NewRedlock("laisky", nil)
+	require.Error(t, err)
+
+	nodes := newRedlockNodes(t, 3)
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	mu1, err := NewRedlock(lockName, nodes)
+	require.NoError(t, err)
+	mu2, err := NewRedlock(lockName, nodes, WithMutexBlockingLock(false))
+	require.NoError(t, err)
+
+	locked, lockCtx, err := mu1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	token1, ok := FencingToken(lockCtx)
+	require.True(t, ok)
+
+	locked, _, err = mu2.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	// should be refreshed
+	time.Sleep(4 * time.Second)
+	require.NoError(t, lockCtx.Err())
+
+	require.NoError(t, mu1.Unlock(ctx))
+	require.Error(t, lockCtx.Err())
+
+	locked, lockCtx, err = mu2.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	token2, ok := FencingToken(lockCtx)
+	require.True(t, ok)
+	require.Greater(t, token2, token1)
+	require.NoError(t, mu2.Unlock(ctx))
+}
+
+func TestNewRedlock_quorum(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	unavailable := NewRedisUtils(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}))
+
+	// majority of nodes are available
+	mu, err := NewRedlock(lockName, append(newRedlockNodes(t, 2), unavailable))
+	require.NoError(t, err)
+	locked, _, err := mu.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, mu.Unlock(ctx))
+
+	// majority of nodes are unavailable
+	mu, err = NewRedlock(lockName,
+		append(newRedlockNodes(t, 1), unavailable, unavailable),
+		WithMutexBlockingLock(false))
+	require.NoError(t, err)
+	locked, _, err = mu.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+}
+
+func TestNewRedlock_Acquire(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mu, err := NewRedlock("laisky"+gutils.RandomStringWithLength(10),
+		newRedlockNodes(t, 3), WithMutexBlockingLock(false))
+	require.NoError(t, err)
+
+	h, err := mu.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = mu.Acquire(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+
+	ttl, err := h.TTL(ctx)
+	require.NoError(t, err)
+	require.Greater(t, ttl, time.Duration(0))
+	require.NoError(t, h.Extend(ctx))
+
+	require.NoError(t, h.Unlock(ctx))
+	require.ErrorIs(t, h.Unlock(ctx), ErrLockReleased)
+	require.ErrorIs(t, mu.Unlock(ctx), ErrLockNotHeld)
+}
+
+func TestNewRedlock_fencingTokenDisjointMajorities(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	nodes := newRedlockNodes(t, 3)
+	unavailable := NewRedisUtils(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}))
+
+	// each acquisition reaches a different majority: {A,B}, {B,C}, {A,C}
+	var last int64
+	for _, majority := range [][]*Utils{
+		{nodes[0], nodes[1], unavailable},
+		{unavailable, nodes[1], nodes[2]},
+		{nodes[0], unavailable, nodes[2]},
+	} {
+		mu, err := NewRedlock(lockName, majority)
+		require.NoError(t, err)
+
+		locked, lockCtx, err := mu.Lock(ctx)
+		require.NoError(t, err)
+		require.True(t, locked)
+		token, ok := FencingToken(lockCtx)
+		require.True(t, ok)
+		require.Greater(t, token, last)
+		last = token
+
+		require.NoError(t, mu.Unlock(ctx))
+	}
+}
+
+func TestNewRedlock_unreachable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		metrics []*Metric
+		clients []*redis.Client
+		nodes   []*Utils
+		lost    = make(chan error, 1)
+	)
+	for i := 0; i < 3; i++ {
+		rdb := redis.NewClient(&redis.Options{DB: i})
+		clients = append(clients, rdb)
+		nodes = append(nodes, NewRedisUtils(rdb,
+			WithUtilsMetrics(MetricsHookFunc(func(ctx context.Context, m *Metric) {
+				mu.Lock()
+				defer mu.Unlock()
+				metrics = append(metrics, m)
+			}))))
+	}
+
+	rl, err := NewRedlock("laisky"+gutils.RandomStringWithLength(10), nodes,
+		WithMutexTTL(time.Second),
+		WithMutexRefreshInterval(200*time.Millisecond),
+		WithMutexRefreshRetryInterval(50*time.Millisecond),
+		WithMutexOnLost(func(reason error) { lost <- reason }),
+	)
+	require.NoError(t, err)
+
+	locked, lockCtx, err := rl.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	mu.Lock()
+	require.Len(t, metrics, 1)
+	require.Equal(t, "redlock", metrics[0].Primitive)
+	require.Equal(t, "lock", metrics[0].Op)
+	require.True(t, metrics[0].OK)
+	mu.Unlock()
+
+	for _, rdb := range clients {
+		require.NoError(t, rdb.Close())
+	}
+
+	// failed unlock should not end the local lease
+	require.Error(t, rl.Unlock(ctx))
+	require.NoError(t, lockCtx.Err())
+
+	// ended by heartbeat once refreshing keeps failing until ttl deadline
+	select {
+	case reason := <-lost:
+		require.ErrorIs(t, reason, ErrLockUnreachable)
+	case <-ctx.Done():
+		t.Fatal("lock not lost")
+	}
+	require.Error(t, lockCtx.Err())
+}
+
+// failNextHook fail the next n commands
+type failNextHook struct {
+	n int32
+}
+
+func (h *failNextHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if atomic.AddInt32(&h.n, -1) >= 0 {
+		return ctx, errors.New("redis unreachable")
+	}
+
+	return ctx, nil
+}
+
+func (h *failNextHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *failNextHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.BeforeProcess(ctx, nil)
+}
+
+func (h *failNextHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestNewRedlock_failedReentrant(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		nodes []*Utils
+		hooks []*failNextHook
+	)
+	for i := 0; i < 3; i++ {
+		rdb := redis.NewClient(&redis.Options{DB: i})
+		hook := new(failNextHook)
+		rdb.AddHook(hook)
+		hooks = append(hooks, hook)
+		nodes = append(nodes, NewRedisUtils(rdb))
+	}
+
+	mu, err := NewRedlock("laisky"+gutils.RandomStringWithLength(10), nodes,
+		WithMutexBlockingLock(false))
+	require.NoError(t, err)
+	rl := mu.(*redlock)
+
+	locked, lockCtx, err := mu.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// reentrant attempt fails on the majority of nodes
+	atomic.StoreInt32(&hooks[1].n, 1)
+	atomic.StoreInt32(&hooks[2].n, 1)
+	locked, _, err = mu.Lock(ctx)
+	require.Error(t, err)
+	require.False(t, locked)
+
+	// outer holder's lease is kept on every node
+	for _, node := range rl.nodes {
+		count, err := node.rdb.HGet(ctx, node.name, "count").Int()
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	}
+	require.NoError(t, lockCtx.Err())
+
+	require.NoError(t, mu.Unlock(ctx))
+	require.Error(t, lockCtx.Err())
+}
+
+func TestNewRedlock_nodeKeyPrefix(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var nodes []*Utils
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, NewRedisUtils(redis.NewClient(&redis.Options{DB: i}),
+			WithUtilsKeyPrefix(fmt.Sprintf("/node%d/", i))))
+	}
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	mu, err := NewRedlock(lockName, nodes)
+	require.NoError(t, err)
+
+	locked, _, err := mu.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// keys are built by each node's own prefix
+	for i, node := range nodes {
+		n, err := node.Exists(ctx, fmt.Sprintf("/node%d/sync/mutex/{%s}", i, lockName)).Result()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+	}
+
+	require.NoError(t, mu.Unlock(ctx))
+}
@@ -0,0 +1,587 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// rwMutexLua common functions of rwmutex scripts,
+// all scripts share the same keys
+//
+// KEYS[1]: writer, hash of owner & count
+// KEYS[2]: readers, client_id -> expire at
+// KEYS[3]: pending writer
+// KEYS[4]: reentrant count of readers, client_id -> count
+const rwMutexLua = `
+-- extend key's ttl, never shorten it, since key is shared by all readers
+local function extend(key, ttl)
+	if redis.call("PTTL", key) < tonumber(ttl) then
+		redis.call("PEXPIRE", key, ttl)
+	end
+end
+
+-- delete expired readers and their reentrant counts
+local function removeExpiredReaders(now)
+	for _, reader in ipairs(redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", now)) do
+		redis.call("HDEL", KEYS[4], reader)
+	end
+	redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", now)
+end
+`
+
+// rwMutexRLockScript acquire or reenter read lock
+//
+// ARGV[1]: client id
+// ARGV[2]: now in milliseconds
+// ARGV[3]: ttl in milliseconds
+//
+// return reentrant count if acquired,
+// 0 if there is a writer holding or waiting for the lock
+var rwMutexRLockScript = redis.NewScript(rwMutexLua + `
+local now = tonumber(ARGV[2])
+removeExpiredReaders(now)
+
+local count
+if not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	local writer = redis.call("HGET", KEYS[1], "owner")
+	if writer and writer ~= ARGV[1] then
+		return 0
+	end
+
+	local pending = redis.call("GET", KEYS[3])
+	if pending and pending ~= ARGV[1] then
+		return 0
+	end
+
+	redis.call("HSET", KEYS[4], ARGV[1], 1)
+	count = 1
+else
+	count = redis.call("HINCRBY", KEYS[4], ARGV[1], 1)
+end
+
+redis.call("ZADD", KEYS[2], now + tonumber(ARGV[3]), ARGV[1])
+extend(KEYS[2], ARGV[3])
+extend(KEYS[4], ARGV[3])
+return count
+`)
+
+// rwMutexLockScript acquire or reenter write lock
+//
+// ARGV[1]: client id
+// ARGV[2]: now in milliseconds
+// ARGV[3]: ttl in milliseconds
+//
+// return reentrant count if acquired, 0 if lock is held by others,
+// -1 if this client holds the read lock shared with other readers.
+// if failed, mark this client as pending writer to block new readers.
+//
+// the only reader is able to upgrade to writer, even if another writer is pending,
+// since the pending writer could not acquire the lock before this reader leaves.
+var rwMutexLockScript = redis.NewScript(rwMutexLua + `
+removeExpiredReaders(ARGV[2])
+
+local writer = redis.call("HGET", KEYS[1], "owner")
+if writer == ARGV[1] then
+	local count = redis.call("HINCRBY", KEYS[1], "count", 1)
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	return count
+end
+
+local readers = redis.call("ZCARD", KEYS[2])
+local upgrade = redis.call("ZSCORE", KEYS[2], ARGV[1])
+if upgrade then
+	if readers > 1 then
+		return -1
+	end
+
+	readers = 0
+end
+
+local pending = redis.call("GET", KEYS[3])
+if writer or readers > 0 or (pending and pending ~= ARGV[1] and not upgrade) then
+	if not pending or pending == ARGV[1] then
+		redis.call("SET", KEYS[3], ARGV[1], "PX", ARGV[3])
+	end
+	return 0
+end
+
+redis.call("HSET", KEYS[1], "owner", ARGV[1], "count", 1)
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+redis.call("DEL", KEYS[3])
+return 1
+`)
+
+// rwMutexCancelScript clear pending writer if it is this client,
+// and notify blocked readers
+//
+// ARGV[1]: client id
+// ARGV[2]: release channel
+//
+// return 1 if cleared, 0 if pending writer is not this client
+var rwMutexCancelScript = redis.NewScript(`
+if redis.call("GET", KEYS[3]) ~= ARGV[1] then
+	return 0
+end
+
+redis.call("DEL", KEYS[3])
+redis.call("PUBLISH", ARGV[2], ARGV[1])
+return 1
+`)
+
+// rwMutexRefreshScript refresh read lock or write lock held by client
+//
+// ARGV[1]: client id
+// ARGV[2]: now in milliseconds
+// ARGV[3]: ttl in milliseconds
+// ARGV[4]: "1" to refresh write lock, otherwise refresh read lock
+//
+// return 1 if refreshed, 0 if lock is not held by this client
+var rwMutexRefreshScript = redis.NewScript(rwMutexLua + `
+if ARGV[4] == "1" then
+	if redis.call("HGET", KEYS[1], "owner") == ARGV[1] then
+		return redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	end
+	return 0
+end
+
+local expireAt = redis.call("ZSCORE", KEYS[2], ARGV[1])
+if not expireAt or tonumber(expireAt) <= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call("ZADD", KEYS[2], tonumber(ARGV[2]) + tonumber(ARGV[3]), ARGV[1])
+extend(KEYS[2], ARGV[3])
+extend(KEYS[4], ARGV[3])
+return 1
+`)
+
+// rwMutexUnlockScript decrease reentrant count of read lock or write lock,
+// release lock and notify waiters if count is zero
+//
+// ARGV[1]: client id
+// ARGV[2]: release channel
+// ARGV[3]: "1" to release write lock, otherwise release read lock
+//
+// return remaining reentrant count, 0 if released,
+// -1 if lock is not held by this client
+var rwMutexUnlockScript = redis.NewScript(rwMutexLua + `
+if ARGV[3] == "1" then
+	if redis.call("HGET", KEYS[1], "owner") ~= ARGV[1] then
+		return -1
+	end
+
+	local count = redis.call("HINCRBY", KEYS[1], "count", -1)
+	if count > 0 then
+		return count
+	end
+
+	redis.call("DEL", KEYS[1])
+else
+	if not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+		return -1
+	end
+
+	local count = redis.call("HINCRBY", KEYS[4], ARGV[1], -1)
+	if count > 0 then
+		return count
+	end
+
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	redis.call("HDEL", KEYS[4], ARGV[1])
+end
+
+redis.call("PUBLISH", ARGV[2], ARGV[1])
+return 0
+`)
+
+// RWMutex distributed reader/writer mutex
+//
+// Redis keys:
+//
+//	`/rtils/sync/rwmutex/{<lock_id>}/`
+//
+//	* writer: hash of client_id & reentrant count of writer
+//	* readers: client_id -> expire at, all readers
+//	* readers/count: client_id -> reentrant count of readers
+//	* pending: client_id of writer who is waiting for readers to leave
+//
+// Implementations:
+//
+// all operations are atomic lua scripts.
+//
+//  1. generate client id(cid)
+//  2. read lock: delete all expired readers,
+//     succeed if there is no writer holding or waiting for the lock,
+//     then add cid:expire_at to `readers` and increase its reentrant count,
+//     each reader has its own expiration in `readers`,
+//     ttl of shared keys is only extended, never shortened
+//  3. write lock: delete all expired readers,
+//     succeed if there is no writer and no reader,
+//     otherwise set `pending` to cid, so no more readers could acquire the lock,
+//     then writers won't be starved by readers.
+//     the only reader could upgrade to writer, but it fails with ErrLockUpgrade
+//     if there are other readers, rather than waiting for itself.
+//     waiting writer clears `pending` once ctx is done
+//  4. if succeeded, auto refresh lock's ttl
+//  5. unlock: decrease reentrant count, if count is zero,
+//     delete cid from `writer` or `readers`, then publish to release channel
+//
+// all goroutines sharing one RWMutex share its client id,
+// so they reenter the same lock rather than exclude each other,
+// lock is released after the outermost unlock.
+type RWMutex interface {
+	// RLock acquire a recursive read lock
+	//
+	// if succeed acquired lock,
+	//   * locked == true
+	//   * lockCtx is context of lock, this context will be set to done when lock is expired
+	//
+	// return locked == false with ErrLockTaken if there is a writer and not blocking.
+	RLock(ctx context.Context) (locked bool, lockCtx context.Context, err error)
+	// RUnlock release read lock, read lock will be released after the outermost RUnlock.
+	//
+	// return ErrLockNotHeld if read lock is not held by this client
+	RUnlock(ctx context.Context) error
+	// Lock acquire a recursive write lock
+	//
+	// if succeed acquired lock,
+	//   * locked == true
+	//   * lockCtx is context of lock, this context will be set to done when lock is expired
+	//
+	// return locked == false with ErrLockTaken if lock is held by others and not blocking,
+	// or with ErrLockUpgrade if this client holds the read lock shared with other readers.
+	Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error)
+	// Unlock release write lock, write lock will be released after the outermost Unlock.
+	//
+	// return ErrLockNotHeld if write lock is not held by this client
+	Unlock(ctx context.Context) error
+}
+
+type rwMutex struct {
+	*mutexOption
+	rdb    *Utils
+	logger gutils.LoggerItf
+
+	rctxs,
+	wctxs lockCtxs
+
+	// writer hash of client id & reentrant count of writer
+	writer,
+	// readers client_id -> expire at
+	readers,
+	// readerCounts client_id -> reentrant count of readers
+	readerCounts,
+	// pending client id of waiting writer
+	pending,
+	// channel pub/sub channel to notify lock released
+	channel string
+}
+
+// RWMutexOptionFunc options for rwmutex
+type RWMutexOptionFunc func(*rwMutex) error
+
+// WithRWMutexSpinInterval set lock spin interval
+func WithRWMutexSpinInterval(interval time.Duration) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.spinInterval = interval
+		return nil
+	}
+}
+
+// WithRWMutexBlockingLock set whether blocking lock
+func WithRWMutexBlockingLock(blocking bool) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.blocking = blocking
+		return nil
+	}
+}
+
+// WithRWMutexReleaseNotify set whether to subscribe release notification
+// when waiting for lock, otherwise spin every spin interval
+func WithRWMutexReleaseNotify(enable bool) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.releaseNotify = enable
+		return nil
+	}
+}
+
+// WithRWMutexNotifyFallbackInterval set retry interval when subscribed release notification,
+// in case of notification is lost or lock is expired without release
+func WithRWMutexNotifyFallbackInterval(interval time.Duration) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.notifyFallbackInterval = interval
+		return nil
+	}
+}
+
+// WithRWMutexRefreshInterval set lock refreshing interval
+func WithRWMutexRefreshInterval(interval time.Duration) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.heartbeatInterval = interval
+		return nil
+	}
+}
+
+// WithRWMutexTTL set lock's expiration
+func WithRWMutexTTL(ttl time.Duration) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.ttl = ttl
+		return nil
+	}
+}
+
+// WithRWMutexRefreshRetryInterval set retry interval when failed to refresh lock,
+// lock keeps retrying until ttl deadline
+func WithRWMutexRefreshRetryInterval(interval time.Duration) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "retry interval must greater than 0")
+		}
+
+		mu.refreshRetryInterval = interval
+		return nil
+	}
+}
+
+// WithRWMutexRefreshGrace consider lock as lost `grace` before ttl deadline
+// if failed to refresh lock, leave time for aborting jobs,
+// grace must less than ttl
+func WithRWMutexRefreshGrace(grace time.Duration) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		if grace < 0 {
+			return errors.Wrap(ErrInvalidArgument, "grace must not less than 0")
+		}
+
+		mu.refreshGrace = grace
+		return nil
+	}
+}
+
+// WithRWMutexOnLost set callback called once when read or write lock is ended,
+// reason is one of ErrLockReleased, ErrLockExpired, ErrLockUnreachable or ctx.Err()
+func WithRWMutexOnLost(onLost func(reason error)) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.onLost = onLost
+		return nil
+	}
+}
+
+// WithRWMutexLogger set lock's logger
+func WithRWMutexLogger(logger *gutils.LoggerType) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.logger = logger
+		return nil
+	}
+}
+
+// WithRWMutexClientID set client id
+func WithRWMutexClientID(clientID string) RWMutexOptionFunc {
+	return func(mu *rwMutex) error {
+		mu.clientID = clientID
+		return nil
+	}
+}
+
+// NewRWMutex new reader/writer mutex
+func (u *Utils) NewRWMutex(lockName string, opts ...RWMutexOptionFunc) (RWMutex, error) {
+	mu := &rwMutex{
+		logger:       u.logger,
+		rdb:          u,
+		writer:       u.buildKey(defaultKeySyncRWMutexWriter, lockName),
+		readers:      u.buildKey(defaultKeySyncRWMutexReaders, lockName),
+		readerCounts: u.buildKey(defaultKeySyncRWMutexReaderCounts, lockName),
+		pending:      u.buildKey(defaultKeySyncRWMutexPending, lockName),
+		channel:      u.buildKey(defaultKeySyncRWMutexRelease, lockName),
+		mutexOption:  u.newMutexOption(),
+	}
+	for _, optf := range opts {
+		if err := optf(mu); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mu.validate(); err != nil {
+		return nil, err
+	}
+
+	return mu, nil
+}
+
+// luaBool convert bool to lua script argument
+func luaBool(v bool) string {
+	if v {
+		return "1"
+	}
+
+	return "0"
+}
+
+// keys keys of lua scripts
+func (m *rwMutex) keys() []string {
+	return []string{m.writer, m.readers, m.pending, m.readerCounts}
+}
+
+// ctxs lock contexts of read or write lock
+func (m *rwMutex) ctxs(write bool) *lockCtxs {
+	if write {
+		return &m.wctxs
+	}
+
+	return &m.rctxs
+}
+
+// refreshLock keep read or write lock alive until lease is ended
+func (m *rwMutex) refreshLock(lease *lockLease, write bool) {
+	keepAlive(lease, m.mutexOption,
+		m.logger.With(zap.String("lock", m.writer), zap.Bool("write", write)),
+		func(ctx context.Context) (bool, error) {
+			ok, err := rwMutexRefreshScript.Run(ctx, m.rdb, m.keys(),
+				m.clientID,
+				m.rdb.clock.GetUTCNow().UnixMilli(),
+				m.ttl.Milliseconds(),
+				luaBool(write),
+			).Bool()
+			if err != nil {
+				return false, errors.Wrapf(err, "renew lock `%s`", m.writer)
+			}
+
+			return ok, nil
+		},
+		func(ctx context.Context) error {
+			return ErrLockExpired
+		},
+	)
+}
+
+func (m *rwMutex) lock(ctx context.Context, write bool) (locked bool, lockCtx context.Context, err error) {
+	script := rwMutexRLockScript
+	if write {
+		script = rwMutexLockScript
+	}
+
+	waiter := newLockWaiter(m.rdb, m.logger, m.channel, m.mutexOption)
+	defer waiter.close()
+
+	if write {
+		// waiting writer gives up, non-blocking writer keeps pending until expired
+		defer func() {
+			if !locked && ctx.Err() != nil {
+				m.cancelPending()
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil, ctx.Err()
+		default:
+		}
+
+		count, err := script.Run(ctx, m.rdb, m.keys(),
+			m.clientID,
+			m.rdb.clock.GetUTCNow().UnixMilli(),
+			m.ttl.Milliseconds(),
+		).Int64()
+		if err != nil {
+			return false, nil, errors.Wrapf(err, "acquire lock `%s`", m.writer)
+		} else if count < 0 {
+			return false, nil, errors.Wrapf(ErrLockUpgrade, "lock `%s`", m.writer)
+		} else if count == 0 {
+			if !m.blocking {
+				return false, nil, errors.Wrapf(ErrLockTaken, "lock `%s`", m.writer)
+			}
+
+			waiter.wait(ctx)
+			continue
+		}
+
+		lockCtx, lease := m.ctxs(write).acquired(ctx, count, m.onLost)
+		if lease != nil {
+			go m.refreshLock(lease, write)
+		}
+
+		return true, lockCtx, nil
+	}
+}
+
+// cancelPending clear pending writer set by this client,
+// so blocked readers could acquire the lock once writer gives up
+func (m *rwMutex) cancelPending() {
+	// ctx of lock may be done already
+	ctx, cancel := context.WithTimeout(context.Background(), m.ttl)
+	defer cancel()
+
+	if err := rwMutexCancelScript.Run(ctx, m.rdb, m.keys(),
+		m.clientID, m.channel,
+	).Err(); err != nil {
+		m.logger.Warn("clear pending writer", zap.String("dbkey", m.pending), zap.Error(err))
+	}
+}
+
+func (m *rwMutex) unlock(ctx context.Context, write bool) error {
+	remaining, err := rwMutexUnlockScript.Run(ctx, m.rdb, m.keys(),
+		m.clientID, m.channel, luaBool(write),
+	).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "release lock `%s`", m.writer)
+	}
+
+	if remaining < 0 {
+		m.logger.Warn("lock not held by this client",
+			zap.String("dbkey", m.writer), zap.Bool("write", write))
+		return ErrLockNotHeld
+	}
+
+	m.ctxs(write).released(remaining)
+	return nil
+}
+
+// RLock acquire a recursive read lock
+//
+// if succeed acquired lock,
+//   - locked == true
+//   - lockCtx is context of lock, this context will be set to done when lock is expired
+func (m *rwMutex) RLock(ctx context.Context) (locked bool, lockCtx context.Context, err error) {
+	defer func(start time.Time) {
+		m.rdb.observe(ctx, "rwmutex", m.writer, "rlock", start, locked, err)
+	}(time.Now())
+
+	return m.lock(ctx, false)
+}
+
+// RUnlock release read lock
+func (m *rwMutex) RUnlock(ctx context.Context) (err error) {
+	defer func(start time.Time) {
+		m.rdb.observe(ctx, "rwmutex", m.writer, "runlock", start, err == nil, err)
+	}(time.Now())
+
+	return m.unlock(ctx, false)
+}
+
+// Lock acquire a recursive write lock
+//
+// if succeed acquired lock,
+//   - locked == true
+//   - lockCtx is context of lock, this context will be set to done when lock is expired
+func (m *rwMutex) Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error) {
+	defer func(start time.Time) {
+		m.rdb.observe(ctx, "rwmutex", m.writer, "lock", start, locked, err)
+	}(time.Now())
+
+	return m.lock(ctx, true)
+}
+
+// Unlock release write lock
+func (m *rwMutex) Unlock(ctx context.Context) (err error) {
+	defer func(start time.Time) {
+		m.rdb.observe(ctx, "rwmutex", m.writer, "unlock", start, err == nil, err)
+	}(time.Now())
+
+	return m.unlock(ctx, true)
+}
@@ -0,0 +1,303 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewRWMutex(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	newMu := func() RWMutex {
+		mu, err := rtils.NewRWMutex(lockName, WithRWMutexBlockingLock(false))
+		require.NoError(t, err)
+		return mu
+	}
+
+	reader1, reader2, writer1, writer2 := newMu(), newMu(), newMu(), newMu()
+
+	// multiple readers
+	locked, rctx1, err := reader1.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	locked, _, err = reader2.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// writer blocked by readers, and mark itself as pending
+	locked, _, err = writer1.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	// new reader blocked by pending writer
+	reader3 := newMu()
+	locked, _, err = reader3.RLock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	// reentrant reader is not blocked
+	locked, nestedCtx, err := reader1.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// read lock is released after the outermost unlock
+	require.NoError(t, reader1.RUnlock(ctx))
+	require.Error(t, nestedCtx.Err())
+	require.NoError(t, rctx1.Err())
+	require.NoError(t, reader1.RUnlock(ctx))
+	require.Error(t, rctx1.Err())
+	require.ErrorIs(t, reader1.RUnlock(ctx), ErrLockNotHeld)
+	require.NoError(t, reader2.RUnlock(ctx))
+
+	// pending writer takes precedence over other writers
+	locked, _, err = writer2.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	locked, wctx, err := writer1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	locked, _, err = reader3.RLock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+	locked, _, err = writer2.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	// lock should be refreshed
+	time.Sleep(4 * time.Second)
+	require.NoError(t, wctx.Err())
+
+	require.NoError(t, writer1.Unlock(ctx))
+	require.Error(t, wctx.Err())
+
+	locked, _, err = writer2.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, writer2.Unlock(ctx))
+
+	locked, _, err = reader3.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, reader3.RUnlock(ctx))
+}
+
+func TestUtils_NewRWMutex_blocking(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	reader, err := rtils.NewRWMutex(lockName)
+	require.NoError(t, err)
+	writer, err := rtils.NewRWMutex(lockName)
+	require.NoError(t, err)
+
+	locked, _, err := reader.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = reader.RUnlock(ctx)
+	}()
+
+	start := time.Now()
+	locked, _, err = writer.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.Less(t, time.Since(start), time.Second)
+	require.NoError(t, writer.Unlock(ctx))
+}
+
+func TestUtils_NewRWMutex_readersExpiration(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	long, err := rtils.NewRWMutex(lockName, WithRWMutexTTL(3*time.Second))
+	require.NoError(t, err)
+	short, err := rtils.NewRWMutex(lockName,
+		WithRWMutexTTL(300*time.Millisecond),
+		WithRWMutexRefreshInterval(100*time.Millisecond))
+	require.NoError(t, err)
+
+	locked, _, err := long.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	locked, _, err = short.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// reader with shorter ttl does not shorten other readers' lease
+	readers := long.(*rwMutex).readers
+	ttl, err := rdb.PTTL(ctx, readers).Result()
+	require.NoError(t, err)
+	require.Greater(t, ttl, time.Second)
+
+	require.NoError(t, short.RUnlock(ctx))
+	require.NoError(t, long.RUnlock(ctx))
+}
+
+func TestUtils_NewRWMutex_concurrent(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mu, err := rtils.NewRWMutex("laisky" + gutils.RandomStringWithLength(10))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(write bool) {
+			defer wg.Done()
+			lock, unlock := mu.RLock, mu.RUnlock
+			if write {
+				lock, unlock = mu.Lock, mu.Unlock
+			}
+
+			for j := 0; j < 10; j++ {
+				if locked, _, err := lock(ctx); err != nil || !locked {
+					t.Errorf("lock: %v", err)
+					return
+				}
+				if err := unlock(ctx); err != nil {
+					t.Errorf("unlock: %v", err)
+					return
+				}
+			}
+		}(i%2 == 0)
+	}
+
+	wg.Wait()
+}
+
+func TestUtils_NewRWMutex_upgrade(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	newMu := func() RWMutex {
+		mu, err := rtils.NewRWMutex(lockName, WithRWMutexBlockingLock(false))
+		require.NoError(t, err)
+		return mu
+	}
+	reader1, reader2, writer := newMu(), newMu(), newMu()
+
+	locked, _, err := reader1.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	locked, _, err = reader2.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// could not upgrade while other readers are holding, and does not block new readers
+	locked, _, err = reader1.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockUpgrade)
+	require.ErrorIs(t, err, ErrNotAcquired)
+	require.False(t, locked)
+	reader3 := newMu()
+	locked, _, err = reader3.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, reader2.RUnlock(ctx))
+	require.NoError(t, reader3.RUnlock(ctx))
+
+	// the only reader upgrades even if another writer is pending
+	locked, _, err = writer.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	locked, _, err = reader1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	locked, _, err = writer.Lock(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+	require.False(t, locked)
+
+	require.NoError(t, reader1.Unlock(ctx))
+	require.NoError(t, reader1.RUnlock(ctx))
+}
+
+func TestUtils_NewRWMutex_cancelPending(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+
+	var (
+		mu      sync.Mutex
+		metrics []*Metric
+	)
+	rtils, err := NewRedisUtilsE(rdb,
+		WithUtilsMetrics(MetricsHookFunc(func(ctx context.Context, m *Metric) {
+			mu.Lock()
+			defer mu.Unlock()
+			metrics = append(metrics, m)
+		})),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	reader, err := rtils.NewRWMutex(lockName, WithRWMutexBlockingLock(false))
+	require.NoError(t, err)
+	writer, err := rtils.NewRWMutex(lockName)
+	require.NoError(t, err)
+
+	locked, _, err := reader.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// waiting writer gives up, new readers are not blocked anymore
+	waitCtx, waitCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer waitCancel()
+	locked, _, err = writer.Lock(waitCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.False(t, locked)
+
+	another, err := rtils.NewRWMutex(lockName, WithRWMutexBlockingLock(false))
+	require.NoError(t, err)
+	locked, _, err = another.RLock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, another.RUnlock(ctx))
+	require.NoError(t, reader.RUnlock(ctx))
+
+	locked, _, err = writer.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, writer.Unlock(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	ops := map[string]int{}
+	for _, m := range metrics {
+		require.Equal(t, "rwmutex", m.Primitive)
+		ops[m.Op]++
+	}
+	require.Equal(t, 2, ops["runlock"])
+	require.Equal(t, 1, ops["unlock"])
+}
@@ -0,0 +1,579 @@
+package redis
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	defaultSchedulerJobTimeout   = time.Hour
+	defaultSchedulerMisfireGrace = 10 * time.Second
+	defaultSchedulerMaxCatchUp   = 10
+	defaultSchedulerCatchUp      = SchedulerCatchUpSkip
+	// schedulerRecordTimeout timeout of recording job's result,
+	// result is recorded even if scheduler is stopped
+	schedulerRecordTimeout = 5 * time.Second
+)
+
+// SchedulerCatchUpPolicy how to handle missed ticks,
+// e.g. all instances were down or the previous run took too long
+type SchedulerCatchUpPolicy string
+
+const (
+	// SchedulerCatchUpSkip skip missed ticks,
+	// only run the latest tick if it is not later than misfire grace
+	SchedulerCatchUpSkip SchedulerCatchUpPolicy = "skip"
+	// SchedulerCatchUpOnce run the latest missed tick once
+	SchedulerCatchUpOnce SchedulerCatchUpPolicy = "once"
+	// SchedulerCatchUpAll run all missed ticks in order,
+	// at most the latest max catch up ticks
+	SchedulerCatchUpAll SchedulerCatchUpPolicy = "all"
+)
+
+// schedulerClaimScript claim a tick of job
+//
+// KEYS[1]: status of job
+// KEYS[2]: lock of tick
+// ARGV[1]: tick in unix milliseconds
+// ARGV[2]: ttl of tick lock in milliseconds
+// ARGV[3]: owner
+//
+// return 1 if claimed, 0 if tick is already claimed,
+// or any later tick has been claimed
+var schedulerClaimScript = redis.NewScript(`
+local last = tonumber(redis.call("HGET", KEYS[1], "last_tick"))
+if last and last >= tonumber(ARGV[1]) then
+	return 0
+end
+if not redis.call("SET", KEYS[2], ARGV[3], "NX", "PX", ARGV[2]) then
+	return 0
+end
+
+redis.call("HSET", KEYS[1], "last_tick", ARGV[1])
+return 1
+`)
+
+// schedulerFinishScript record result of a tick, then release tick lock
+//
+// KEYS[1]: status of job
+// KEYS[2]: lock of tick
+// ARGV[1]: tick in unix milliseconds
+// ARGV[2]: started at in unix milliseconds
+// ARGV[3]: duration in milliseconds
+// ARGV[4]: error message, empty if succeeded
+// ARGV[5]: owner
+//
+// return 1 if recorded, 0 if result of a later tick has been recorded
+var schedulerFinishScript = redis.NewScript(`
+if redis.call("GET", KEYS[2]) == ARGV[5] then
+	redis.call("DEL", KEYS[2])
+end
+
+local last = tonumber(redis.call("HGET", KEYS[1], "last_run_tick"))
+if last and last > tonumber(ARGV[1]) then
+	return 0
+end
+
+redis.call("HSET", KEYS[1],
+	"last_run_tick", ARGV[1],
+	"last_run", ARGV[2],
+	"last_duration", ARGV[3],
+	"last_error", ARGV[4],
+	"owner", ARGV[5])
+return 1
+`)
+
+// SchedulerJob periodic job
+//
+// tick is the scheduled time of this run,
+// ctx will be set to done when job is timeout or scheduler is stopped.
+type SchedulerJob func(ctx context.Context, tick time.Time) error
+
+// SchedulerJobStatus status of job recorded in redis
+type SchedulerJobStatus struct {
+	// LastTick the latest claimed tick
+	LastTick time.Time
+	// LastRunTick tick of the last finished run
+	LastRunTick time.Time
+	// LastRun when the last finished run started
+	LastRun time.Time
+	// LastDuration duration of the last finished run
+	LastDuration time.Duration
+	// LastError error of the last finished run, empty if succeeded
+	LastError string
+	// NextRun when the next tick is scheduled
+	NextRun time.Time
+	// Owner instance ran the last finished run
+	Owner string
+}
+
+// Scheduler distributed cron/interval scheduler
+//
+// Redis keys:
+//
+//	`/rtils/sync/scheduler/{<scheduler_name>}/jobs/<job_name>`: hash of job's status
+//	`/rtils/sync/scheduler/{<scheduler_name>}/jobs/<job_name>/ticks/<unix_ms>`: lock of tick
+//
+// Implementations:
+//
+// every instance runs the same schedule, ticks are deterministic times,
+// cron ticks are computed in job's location (UTC in default),
+// interval ticks are aligned to multiples of interval since zero time.
+// instances' clocks should be synchronized.
+//
+//  1. wake up at the next tick, list ticks after the latest claimed tick
+//     (`last_tick`) until now, filter them by catch up policy
+//  2. claim each tick by lua script: succeed only if the tick is later than `last_tick`
+//     and tick lock is set by `SET NX PX <timeout>`, then move `last_tick` forward,
+//     so each tick runs exactly once across all instances
+//  3. run job with timeout, then record last run, duration, error and owner,
+//     and release tick lock
+//  4. record next run
+type Scheduler interface {
+	// AddCronJob register job by cron expression,
+	// standard 5 fields, or descriptors like `@hourly`, `@every 1m`
+	AddCronJob(name, spec string, job SchedulerJob, opts ...SchedulerJobOptionFunc) error
+	// AddIntervalJob register job runs every interval
+	AddIntervalJob(name string, interval time.Duration, job SchedulerJob, opts ...SchedulerJobOptionFunc) error
+	// Run run all registered jobs, block until ctx done and all running jobs finished
+	Run(ctx context.Context) error
+	// JobStatus load job's status from redis
+	JobStatus(ctx context.Context, name string) (*SchedulerJobStatus, error)
+}
+
+// intervalSchedule ticks aligned to multiples of interval since zero time
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+// Next the first tick after t
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Truncate(s.interval).Add(s.interval)
+}
+
+type schedulerJobOption struct {
+	timeout      time.Duration
+	misfireGrace time.Duration
+	catchUp      SchedulerCatchUpPolicy
+	maxCatchUp   int
+	location     *time.Location
+}
+
+type schedulerJob struct {
+	schedulerJobOption
+	name     string
+	key      string
+	schedule cron.Schedule
+	job      SchedulerJob
+}
+
+// SchedulerJobOptionFunc options for scheduler job
+type SchedulerJobOptionFunc func(*schedulerJob) error
+
+// WithSchedulerJobTimeout set timeout of each run,
+// tick lock expires after timeout as well
+func WithSchedulerJobTimeout(timeout time.Duration) SchedulerJobOptionFunc {
+	return func(j *schedulerJob) error {
+		if timeout < time.Millisecond {
+			return errors.Wrap(ErrInvalidArgument, "timeout must not less than 1ms")
+		}
+
+		j.timeout = timeout
+		return nil
+	}
+}
+
+// WithSchedulerJobMisfireGrace set how late a tick could still be run
+// by `SchedulerCatchUpSkip`
+func WithSchedulerJobMisfireGrace(grace time.Duration) SchedulerJobOptionFunc {
+	return func(j *schedulerJob) error {
+		if grace < 0 {
+			return errors.Wrap(ErrInvalidArgument, "misfire grace must not less than 0")
+		}
+
+		j.misfireGrace = grace
+		return nil
+	}
+}
+
+// WithSchedulerJobCatchUp set policy of missed ticks, default is `SchedulerCatchUpSkip`
+func WithSchedulerJobCatchUp(policy SchedulerCatchUpPolicy) SchedulerJobOptionFunc {
+	return func(j *schedulerJob) error {
+		switch policy {
+		case SchedulerCatchUpSkip, SchedulerCatchUpOnce, SchedulerCatchUpAll:
+		default:
+			return errors.Wrapf(ErrInvalidArgument, "unknown catch up policy `%s`", policy)
+		}
+
+		j.catchUp = policy
+		return nil
+	}
+}
+
+// WithSchedulerJobMaxCatchUp set max missed ticks to run by `SchedulerCatchUpAll`
+func WithSchedulerJobMaxCatchUp(n int) SchedulerJobOptionFunc {
+	return func(j *schedulerJob) error {
+		if n <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "max catch up must greater than 0")
+		}
+
+		j.maxCatchUp = n
+		return nil
+	}
+}
+
+// WithSchedulerJobLocation set location of cron expression, default is UTC,
+// ignored if expression specifies `CRON_TZ=`
+func WithSchedulerJobLocation(loc *time.Location) SchedulerJobOptionFunc {
+	return func(j *schedulerJob) error {
+		if loc == nil {
+			return errors.Wrap(ErrInvalidArgument, "location must not be nil")
+		}
+
+		j.location = loc
+		return nil
+	}
+}
+
+type scheduler struct {
+	rdb    *Utils
+	logger gutils.LoggerItf
+	name   string
+	owner  string
+
+	mu      sync.Mutex
+	running bool
+	jobs    []*schedulerJob
+}
+
+// SchedulerOptionFunc options for scheduler
+type SchedulerOptionFunc func(*scheduler) error
+
+// WithSchedulerOwner set id of this instance recorded in job's status,
+// default is `<hostname>/<uuid>`
+func WithSchedulerOwner(owner string) SchedulerOptionFunc {
+	return func(s *scheduler) error {
+		if owner == "" {
+			return errors.Wrap(ErrInvalidArgument, "owner must not be empty")
+		}
+
+		s.owner = owner
+		return nil
+	}
+}
+
+// WithSchedulerLogger set scheduler's logger
+func WithSchedulerLogger(logger *gutils.LoggerType) SchedulerOptionFunc {
+	return func(s *scheduler) error {
+		s.logger = logger
+		return nil
+	}
+}
+
+// NewScheduler new distributed scheduler
+//
+// instances with the same name share the same jobs' ticks.
+func (u *Utils) NewScheduler(name string, opts ...SchedulerOptionFunc) (Scheduler, error) {
+	if name == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, "name must not be empty")
+	}
+
+	hostname, _ := os.Hostname()
+	s := &scheduler{
+		rdb:    u,
+		logger: u.logger,
+		name:   name,
+		owner:  hostname + "/" + uuid.New().String(),
+	}
+	for _, optf := range opts {
+		if err := optf(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// AddCronJob register job by cron expression
+func (s *scheduler) AddCronJob(name, spec string, job SchedulerJob, opts ...SchedulerJobOptionFunc) error {
+	j, err := s.newJob(name, job, opts)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidArgument, "parse cron `%s`: %s", spec, err.Error())
+	}
+	if sched, ok := schedule.(*cron.SpecSchedule); ok &&
+		!strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		sched.Location = j.location
+	}
+
+	j.schedule = schedule
+	return s.addJob(j)
+}
+
+// AddIntervalJob register job runs every interval
+func (s *scheduler) AddIntervalJob(name string, interval time.Duration, job SchedulerJob, opts ...SchedulerJobOptionFunc) error {
+	if interval < time.Millisecond {
+		return errors.Wrap(ErrInvalidArgument, "interval must not less than 1ms")
+	}
+
+	j, err := s.newJob(name, job, opts)
+	if err != nil {
+		return err
+	}
+
+	j.schedule = intervalSchedule{interval: interval}
+	return s.addJob(j)
+}
+
+func (s *scheduler) newJob(name string, job SchedulerJob, opts []SchedulerJobOptionFunc) (*schedulerJob, error) {
+	if name == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, "job name must not be empty")
+	}
+	if job == nil {
+		return nil, errors.Wrap(ErrInvalidArgument, "job must not be nil")
+	}
+
+	j := &schedulerJob{
+		name: name,
+		key:  s.rdb.buildKey(defaultKeySyncSchedulerJob, s.name, name),
+		job:  job,
+		schedulerJobOption: schedulerJobOption{
+			timeout:      defaultSchedulerJobTimeout,
+			misfireGrace: defaultSchedulerMisfireGrace,
+			catchUp:      defaultSchedulerCatchUp,
+			maxCatchUp:   defaultSchedulerMaxCatchUp,
+			location:     time.UTC,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(j); err != nil {
+			return nil, err
+		}
+	}
+
+	return j, nil
+}
+
+func (s *scheduler) addJob(j *schedulerJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return errors.Errorf("scheduler `%s` is running", s.name)
+	}
+
+	for _, job := range s.jobs {
+		if job.name == j.name {
+			return errors.Wrapf(ErrInvalidArgument, "job `%s` already exists", j.name)
+		}
+	}
+
+	s.jobs = append(s.jobs, j)
+	return nil
+}
+
+// Run run all registered jobs, block until ctx done and all running jobs finished
+func (s *scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return errors.Errorf("scheduler `%s` is running", s.name)
+	}
+	s.running = true
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j *schedulerJob) {
+			defer wg.Done()
+			s.runJob(ctx, j)
+		}(j)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// runJob run ticks of job until ctx done
+func (s *scheduler) runJob(ctx context.Context, j *schedulerJob) {
+	logger := s.logger.With(zap.String("scheduler", s.name), zap.String("job", j.name))
+	for {
+		now := s.rdb.clock.GetUTCNow()
+		if last, err := s.lastTick(ctx, j, now); err != nil {
+			logger.Warn("load last tick", zap.Error(err))
+		} else {
+			for _, tick := range j.dueTicks(last, now) {
+				if ctx.Err() != nil {
+					return
+				}
+
+				s.runTick(ctx, logger, j, tick)
+			}
+		}
+
+		now = s.rdb.clock.GetUTCNow()
+		next := j.schedule.Next(now)
+		if next.IsZero() {
+			logger.Warn("no more ticks")
+			return
+		}
+
+		if err := s.rdb.HSet(ctx, j.key, "next_run", next.UnixMilli()).Err(); err != nil {
+			logger.Warn("record next run", zap.Error(err))
+		}
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// lastTick the latest claimed tick,
+// `now - misfireGrace` if job never ran
+func (s *scheduler) lastTick(ctx context.Context, j *schedulerJob, now time.Time) (time.Time, error) {
+	ms, err := s.rdb.HGet(ctx, j.key, "last_tick").Int64()
+	if IsNil(err) {
+		return now.Add(-j.misfireGrace), nil
+	} else if err != nil {
+		return time.Time{}, errors.Wrapf(err, "load last tick of job `%s`", j.name)
+	}
+
+	return time.UnixMilli(ms).UTC(), nil
+}
+
+// dueTicks ticks after last until now, filtered by catch up policy
+func (j *schedulerJob) dueTicks(last, now time.Time) (ticks []time.Time) {
+	keep := 1
+	if j.catchUp == SchedulerCatchUpAll {
+		keep = j.maxCatchUp
+	}
+
+	for t := j.schedule.Next(last); !t.IsZero() && !t.After(now); t = j.schedule.Next(t) {
+		ticks = append(ticks, t)
+		if len(ticks) > keep {
+			ticks = ticks[1:]
+		}
+	}
+
+	if j.catchUp == SchedulerCatchUpSkip && len(ticks) != 0 &&
+		now.Sub(ticks[len(ticks)-1]) > j.misfireGrace {
+		return nil
+	}
+
+	return ticks
+}
+
+// runTick claim tick, run job and record result
+func (s *scheduler) runTick(ctx context.Context, logger gutils.LoggerItf, j *schedulerJob, tick time.Time) {
+	logger = logger.With(zap.Time("tick", tick))
+	tickKey := s.rdb.buildKey(defaultKeySyncSchedulerTick, s.name, j.name, tick.UnixMilli())
+	claimed, err := schedulerClaimScript.Run(ctx, s.rdb,
+		[]string{j.key, tickKey},
+		tick.UnixMilli(),
+		j.timeout.Milliseconds(),
+		s.owner,
+	).Bool()
+	if err != nil {
+		logger.Warn("claim tick", zap.Error(err))
+		return
+	} else if !claimed {
+		logger.Debug("tick already claimed")
+		return
+	}
+
+	start := time.Now()
+	startAt := s.rdb.clock.GetUTCNow()
+	err = s.call(ctx, j, tick)
+	s.rdb.observe(ctx, "scheduler", j.key, "run", start, err == nil, err)
+
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+		logger.Error("run job", zap.Error(err))
+	} else {
+		logger.Debug("succeed run job")
+	}
+
+	recordCtx, cancel := context.WithTimeout(context.Background(), schedulerRecordTimeout)
+	defer cancel()
+	if err = schedulerFinishScript.Run(recordCtx, s.rdb,
+		[]string{j.key, tickKey},
+		tick.UnixMilli(),
+		startAt.UnixMilli(),
+		time.Since(start).Milliseconds(),
+		errMsg,
+		s.owner,
+	).Err(); err != nil {
+		logger.Warn("record job result", zap.Error(err))
+	}
+}
+
+// call run job with timeout, recover panic as error
+func (s *scheduler) call(ctx context.Context, j *schedulerJob, tick time.Time) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, j.timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("job panic: %v", r)
+		}
+	}()
+
+	return j.job(ctx, tick)
+}
+
+// JobStatus load job's status from redis
+func (s *scheduler) JobStatus(ctx context.Context, name string) (*SchedulerJobStatus, error) {
+	ret, err := s.rdb.HGetAll(ctx, s.rdb.buildKey(defaultKeySyncSchedulerJob, s.name, name)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "load status of job `%s`", name)
+	}
+
+	msTime := func(field string) time.Time {
+		ms, err := strconv.ParseInt(ret[field], 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+
+		return time.UnixMilli(ms).UTC()
+	}
+
+	status := &SchedulerJobStatus{
+		LastTick:    msTime("last_tick"),
+		LastRunTick: msTime("last_run_tick"),
+		LastRun:     msTime("last_run"),
+		LastError:   ret["last_error"],
+		NextRun:     msTime("next_run"),
+		Owner:       ret["owner"],
+	}
+	if ms, err := strconv.ParseInt(ret["last_duration"], 10, 64); err == nil {
+		status.LastDuration = time.Duration(ms) * time.Millisecond
+	}
+
+	return status, nil
+}
@@ -0,0 +1,171 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerJob_dueTicks(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 10, 5, 0, time.UTC)
+	last := now.Add(-5 * time.Minute)
+	newJob := func(policy SchedulerCatchUpPolicy) *schedulerJob {
+		return &schedulerJob{
+			schedule: intervalSchedule{interval: time.Minute},
+			schedulerJobOption: schedulerJobOption{
+				misfireGrace: 10 * time.Second,
+				catchUp:      policy,
+				maxCatchUp:   3,
+			},
+		}
+	}
+
+	// latest tick 00:10:00 is 5s late, within misfire grace
+	require.Equal(t, []time.Time{now.Truncate(time.Minute)},
+		newJob(SchedulerCatchUpSkip).dueTicks(last, now))
+	require.Empty(t, newJob(SchedulerCatchUpSkip).dueTicks(last, now.Add(10*time.Second)))
+	require.Empty(t, newJob(SchedulerCatchUpSkip).dueTicks(now, now))
+
+	require.Equal(t, []time.Time{now.Truncate(time.Minute)},
+		newJob(SchedulerCatchUpOnce).dueTicks(last, now.Add(30*time.Second)))
+
+	ticks := newJob(SchedulerCatchUpAll).dueTicks(last, now)
+	require.Equal(t, []time.Time{
+		time.Date(2022, 1, 1, 0, 8, 0, 0, time.UTC),
+		time.Date(2022, 1, 1, 0, 9, 0, 0, time.UTC),
+		time.Date(2022, 1, 1, 0, 10, 0, 0, time.UTC),
+	}, ticks)
+}
+
+func TestUtils_NewScheduler(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	_, err := rtils.NewScheduler("")
+	require.ErrorIs(t, err, ErrInvalidArgument)
+
+	sch, err := rtils.NewScheduler("laisky")
+	require.NoError(t, err)
+	job := func(ctx context.Context, tick time.Time) error { return nil }
+	require.ErrorIs(t, sch.AddCronJob("cron", "invalid", job), ErrInvalidArgument)
+	require.ErrorIs(t, sch.AddIntervalJob("interval", 0, job), ErrInvalidArgument)
+	require.ErrorIs(t, sch.AddIntervalJob("", time.Second, job), ErrInvalidArgument)
+	require.ErrorIs(t, sch.AddIntervalJob("interval", time.Second, job,
+		WithSchedulerJobCatchUp("unknown")), ErrInvalidArgument)
+	require.NoError(t, sch.AddCronJob("cron", "*/5 * * * *", job))
+	require.NoError(t, sch.AddIntervalJob("interval", time.Second, job))
+	require.ErrorIs(t, sch.AddIntervalJob("interval", time.Second, job), ErrInvalidArgument)
+}
+
+func TestScheduler_Run(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+	defer cancel()
+
+	var (
+		mu    sync.Mutex
+		ticks = map[time.Time]int{}
+		name  = "laisky" + gutils.RandomStringWithLength(10)
+	)
+	job := func(ctx context.Context, tick time.Time) error {
+		mu.Lock()
+		ticks[tick]++
+		mu.Unlock()
+		return errors.New("job failed")
+	}
+
+	// all instances share the same ticks
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		sch, err := rtils.NewScheduler(name)
+		require.NoError(t, err)
+		require.NoError(t, sch.AddIntervalJob("job", 200*time.Millisecond, job))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, sch.Run(ctx))
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	require.GreaterOrEqual(t, len(ticks), 4)
+	for tick, n := range ticks {
+		require.Equal(t, 1, n, "tick %s run %d times", tick, n)
+	}
+	mu.Unlock()
+
+	sch, err := rtils.NewScheduler(name)
+	require.NoError(t, err)
+	status, err := sch.JobStatus(context.Background(), "job")
+	require.NoError(t, err)
+	require.Equal(t, "job failed", status.LastError)
+	require.False(t, status.LastRun.IsZero())
+	require.Equal(t, status.LastTick, status.LastRunTick)
+	require.True(t, status.NextRun.After(status.LastTick))
+	require.NotEmpty(t, status.Owner)
+}
+
+func TestScheduler_catchUp(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	for policy, expect := range map[SchedulerCatchUpPolicy]int{
+		SchedulerCatchUpOnce: 1,
+		SchedulerCatchUpAll:  5,
+	} {
+		t.Run(string(policy), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			name := "laisky" + gutils.RandomStringWithLength(10)
+			last := time.Now().Add(-5 * time.Minute)
+			require.NoError(t, rdb.HSet(ctx,
+				rtils.buildKey(defaultKeySyncSchedulerJob, name, "job"),
+				"last_tick", last.UnixMilli()).Err())
+
+			ran := make(chan time.Time, 10)
+			sch, err := rtils.NewScheduler(name)
+			require.NoError(t, err)
+			require.NoError(t, sch.AddIntervalJob("job", time.Minute,
+				func(ctx context.Context, tick time.Time) error {
+					ran <- tick
+					return nil
+				},
+				WithSchedulerJobCatchUp(policy)))
+
+			done := make(chan error)
+			go func() { done <- sch.Run(ctx) }()
+
+			var prev time.Time
+			for i := 0; i < expect; i++ {
+				select {
+				case tick := <-ran:
+					require.True(t, tick.After(last))
+					require.True(t, tick.After(prev))
+					prev = tick
+				case <-time.After(3 * time.Second):
+					t.Fatalf("only %d ticks run", i)
+				}
+			}
+
+			select {
+			case tick := <-ran:
+				t.Fatalf("unexpected tick %s", tick)
+			case <-time.After(200 * time.Millisecond):
+			}
+
+			cancel()
+			require.NoError(t, <-done)
+		})
+	}
+}
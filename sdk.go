@@ -1,20 +1,480 @@
 package redis
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
 	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
 )
 
 // Utils utils enhancemant for redis
+//
+// works with any `redis.UniversalClient`, including
+// `*redis.Client`, `*redis.ClusterClient`, failover client and `*redis.Ring`.
 type Utils struct {
-	*redis.Client
-	logger gutils.LoggerItf
+	redis.UniversalClient
+	logger     gutils.LoggerItf
+	keyPrefix  string
+	keyBuilder KeyBuilder
+	clock      Clock
+	metrics    MetricsHook
+	lockTTL    time.Duration
+	cacheTTL   time.Duration
+	probe      time.Duration
+
+	versionMu sync.Mutex
+	version   []int
+}
+
+// Clock time source of client side
+type Clock interface {
+	GetUTCNow() time.Time
+}
+
+// Metric one operation of primitive
+type Metric struct {
+	// Primitive e.g. `mutex`, `semaphore`, `cache`
+	Primitive string
+	// Name redis key of primitive
+	Name string
+	// Op e.g. `lock`, `unlock`, `get`
+	Op string
+	// OK whether operation succeed, e.g. lock acquired, cache hit
+	OK      bool
+	Elapsed time.Duration
+	Err     error
+}
+
+// MetricsHook receive metrics of primitives
+type MetricsHook interface {
+	// Observe called after each operation of primitives,
+	// should not block
+	Observe(ctx context.Context, m *Metric)
+}
+
+// MetricsHookFunc adapter of MetricsHook
+type MetricsHookFunc func(ctx context.Context, m *Metric)
+
+// Observe call f
+func (f MetricsHookFunc) Observe(ctx context.Context, m *Metric) {
+	f(ctx, m)
+}
+
+// KeyBuilder build redis key of all primitives,
+// key is relative to prefix, e.g. `sync/mutex/{<lock_name>}`
+//
+// alphanumeric characters of key should be kept as is in the built key,
+// and the built key should differ by prefix, otherwise keys under namespace
+// can not be matched by `ListNamespaceKeys` and `DeleteNamespace`.
+type KeyBuilder func(prefix, key string) string
+
+// defaultKeyBuilder concat prefix and key
+func defaultKeyBuilder(prefix, key string) string {
+	return prefix + key
+}
+
+// UtilsOptionFunc options for Utils
+type UtilsOptionFunc func(*Utils) error
+
+// WithUtilsKeyPrefix set prefix of all keys, default is `DefaultKeyPrefix`,
+// different apps sharing the same redis should use different prefixes
+func WithUtilsKeyPrefix(prefix string) UtilsOptionFunc {
+	return func(u *Utils) error {
+		if prefix == "" {
+			return errors.Errorf("key prefix must not be empty")
+		}
+
+		u.keyPrefix = prefix
+		return nil
+	}
+}
+
+// WithUtilsKeyBuilder set builder of all keys
+func WithUtilsKeyBuilder(builder KeyBuilder) UtilsOptionFunc {
+	return func(u *Utils) error {
+		if builder == nil {
+			return errors.Errorf("key builder must not be nil")
+		}
+
+		u.keyBuilder = builder
+		return nil
+	}
+}
+
+// WithUtilsLogger set logger of utils and all primitives created by utils,
+// default is go-redis logger, which could be changed by `SetLogger` at any time
+func WithUtilsLogger(logger gutils.LoggerItf) UtilsOptionFunc {
+	return func(u *Utils) error {
+		if logger == nil {
+			return errors.Errorf("logger must not be nil")
+		}
+
+		u.logger = logger
+		return nil
+	}
+}
+
+// WithUtilsClock set time source of client side, default is `gutils.Clock`
+func WithUtilsClock(clock Clock) UtilsOptionFunc {
+	return func(u *Utils) error {
+		if clock == nil {
+			return errors.Errorf("clock must not be nil")
+		}
+
+		u.clock = clock
+		return nil
+	}
+}
+
+// WithUtilsMetrics set metrics hook of primitives
+func WithUtilsMetrics(hook MetricsHook) UtilsOptionFunc {
+	return func(u *Utils) error {
+		u.metrics = hook
+		return nil
+	}
+}
+
+// WithUtilsLockTTL set default ttl of mutex, rwmutex and semaphore,
+// heartbeat interval will be `ttl/3`
+func WithUtilsLockTTL(ttl time.Duration) UtilsOptionFunc {
+	return func(u *Utils) error {
+		if ttl < 3*time.Millisecond {
+			return errors.Errorf("lock ttl must not less than 3ms")
+		}
+
+		u.lockTTL = ttl
+		return nil
+	}
+}
+
+// WithUtilsCacheTTL set default ttl of `Cache.GetOrLoad` when ttl is 0
+func WithUtilsCacheTTL(ttl time.Duration) UtilsOptionFunc {
+	return func(u *Utils) error {
+		if ttl <= 0 {
+			return errors.Errorf("cache ttl must greater than 0")
+		}
+
+		u.cacheTTL = ttl
+		return nil
+	}
+}
+
+// WithUtilsStartupProbe ping server and detect server version
+// when creating utils, `NewRedisUtilsE` returns error if ping failed
+func WithUtilsStartupProbe(timeout time.Duration) UtilsOptionFunc {
+	return func(u *Utils) error {
+		if timeout <= 0 {
+			return errors.Errorf("timeout must greater than 0")
+		}
+
+		u.probe = timeout
+		return nil
+	}
 }
 
 // NewRedisUtils wrap redis client with utils
-func NewRedisUtils(rdb *redis.Client) *Utils {
+//
+// rdb could be any of `*redis.Client`, `*redis.ClusterClient`,
+// `redis.NewFailoverClient` or `*redis.Ring`.
+//
+// invalid options are logged and ignored, failed startup probe is logged,
+// use `NewRedisUtilsE` to get these errors.
+func NewRedisUtils(rdb redis.UniversalClient, opts ...UtilsOptionFunc) *Utils {
+	u := newUtils(rdb)
+	for _, optf := range opts {
+		if err := optf(u); err != nil {
+			u.logger.Warn("ignore invalid utils option", zap.Error(err))
+		}
+	}
+
+	if err := u.startupProbe(); err != nil {
+		u.logger.Warn("startup probe", zap.Error(err))
+	}
+
+	return u
+}
+
+// NewRedisUtilsE wrap redis client with utils,
+// return error if any option is invalid or startup probe failed
+func NewRedisUtilsE(rdb redis.UniversalClient, opts ...UtilsOptionFunc) (*Utils, error) {
+	u := newUtils(rdb)
+	for _, optf := range opts {
+		if err := optf(u); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := u.startupProbe(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func newUtils(rdb redis.UniversalClient) *Utils {
 	return &Utils{
-		Client: rdb,
-		logger: logger,
+		UniversalClient: rdb,
+		logger:          &globalLogger{},
+		keyPrefix:       DefaultKeyPrefix,
+		keyBuilder:      defaultKeyBuilder,
+		clock:           gutils.Clock,
+	}
+}
+
+// startupProbe ping server and detect server version if enabled by `WithUtilsStartupProbe`
+func (u *Utils) startupProbe() error {
+	if u.probe == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.probe)
+	defer cancel()
+
+	if err := u.Ping(ctx).Err(); err != nil {
+		return errors.Wrap(err, "ping redis")
+	}
+
+	if version, err := u.ServerVersion(ctx); err != nil {
+		u.logger.Warn("detect server version, redis 7 commands are disabled", zap.Error(err))
+	} else {
+		u.logger.Debug("detected server version", zap.Ints("version", version))
 	}
+
+	return nil
+}
+
+// observe report metric to metrics hook
+func (u *Utils) observe(ctx context.Context, primitive, name, op string,
+	start time.Time, ok bool, err error) {
+	if u.metrics == nil {
+		return
+	}
+
+	u.metrics.Observe(ctx, &Metric{
+		Primitive: primitive,
+		Name:      name,
+		Op:        op,
+		OK:        ok,
+		Elapsed:   time.Since(start),
+		Err:       err,
+	})
+}
+
+// buildKey build key in namespace by format in `keys.go`
+func (u *Utils) buildKey(format string, args ...interface{}) string {
+	return u.keyBuilder(u.keyPrefix, fmt.Sprintf(format, args...))
+}
+
+// ServerVersion detect version of redis server by `INFO server`,
+// return `[major, minor, patch]`, cached after first succeed detection.
+//
+// for cluster, the version of a random node is returned.
+func (u *Utils) ServerVersion(ctx context.Context) ([]int, error) {
+	u.versionMu.Lock()
+	defer u.versionMu.Unlock()
+	if u.version != nil {
+		return u.version, nil
+	}
+
+	info, err := u.UniversalClient.Info(ctx, "server").Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "get server info")
+	}
+
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "redis_version:") {
+			continue
+		}
+
+		version := make([]int, 3)
+		for i, v := range strings.SplitN(strings.TrimPrefix(line, "redis_version:"), ".", 3) {
+			if version[i], err = strconv.Atoi(v); err != nil {
+				return nil, errors.Wrapf(err, "parse redis version `%s`", line)
+			}
+		}
+
+		u.version = version
+		return version, nil
+	}
+
+	return nil, errors.Errorf("redis_version not found in server info")
+}
+
+// capability commands available since redis `major.minor`
+type capability struct {
+	major, minor int
+}
+
+var (
+	// capClientTracking `CLIENT TRACKING`
+	capClientTracking = capability{6, 0}
+	// capScanType `SCAN ... TYPE type`
+	capScanType = capability{6, 0}
+	// capBLMove `BLMOVE`
+	capBLMove = capability{6, 2}
+	// capPopCount `LPOP key count` & `RPOP key count`
+	capPopCount = capability{6, 2}
+	// capBLMPop `BLMPOP`
+	capBLMPop = capability{7, 0}
+)
+
+// supports whether server supports capability,
+// return false if version can not be detected
+func (u *Utils) supports(ctx context.Context, c capability) bool {
+	version, err := u.ServerVersion(ctx)
+	if err != nil {
+		u.logger.Debug("detect server version", zap.Error(err))
+		return false
+	}
+
+	return version[0] > c.major || (version[0] == c.major && version[1] >= c.minor)
+}
+
+// shards clients of all masters in cluster mode, or all shards of ring,
+// return nil for other clients, which could be used directly
+func (u *Utils) shards(ctx context.Context) (clients []*redis.Client, err error) {
+	var mu sync.Mutex
+	collect := func(ctx context.Context, c *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		clients = append(clients, c)
+		return nil
+	}
+
+	switch rdb := u.UniversalClient.(type) {
+	case *redis.ClusterClient:
+		err = rdb.ForEachMaster(ctx, collect)
+	case *redis.Ring:
+		err = rdb.ForEachShard(ctx, collect)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "list shards")
+	}
+
+	return clients, nil
+}
+
+// KeyPrefix prefix of all keys
+func (u *Utils) KeyPrefix() string {
+	return u.keyPrefix
+}
+
+// globEscaper escape special characters of glob pattern
+var globEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`?`, `\?`,
+	`[`, `\[`,
+	`]`, `\]`,
+)
+
+// namespaceMarker placeholder of relative key to derive namespace pattern from key builder
+const namespaceMarker = "rtilsnamespacemarker"
+
+// namespacePattern glob pattern matches all keys built by key builder under key prefix
+func (u *Utils) namespacePattern() (string, error) {
+	key := u.keyBuilder(u.keyPrefix, namespaceMarker)
+	i := strings.Index(key, namespaceMarker)
+	if i < 0 {
+		return "", errors.Wrapf(ErrInvalidArgument,
+			"key builder does not keep relative key, got `%s`", key)
+	}
+
+	head, tail := key[:i], key[i+len(namespaceMarker):]
+	if head == "" && tail == "" {
+		return "", errors.Wrap(ErrInvalidArgument, "key builder does not build key in namespace")
+	}
+
+	return globEscaper.Replace(head) + "*" + globEscaper.Replace(tail), nil
+}
+
+// scanNamespace scan all keys under key prefix,
+// scan all masters in cluster mode, and all shards of ring
+func (u *Utils) scanNamespace(ctx context.Context, fn func(keys []string) error) error {
+	match, err := u.namespacePattern()
+	if err != nil {
+		return err
+	}
+
+	scan := func(ctx context.Context, rdb redis.Cmdable, fn func(keys []string) error) error {
+		var cursor uint64
+		for {
+			keys, next, err := rdb.Scan(ctx, cursor, match, ScanCount).Result()
+			if err != nil {
+				return errors.Wrapf(err, "scan `%s`", match)
+			}
+
+			if len(keys) != 0 {
+				if err = fn(keys); err != nil {
+					return err
+				}
+			}
+
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	}
+
+	shards, err := u.shards(ctx)
+	if err != nil {
+		return err
+	}
+	if len(shards) == 0 {
+		return scan(ctx, u.UniversalClient, fn)
+	}
+
+	for _, rdb := range shards {
+		if err = scan(ctx, rdb, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListNamespaceKeys list all keys under key prefix
+func (u *Utils) ListNamespaceKeys(ctx context.Context) (keys []string, err error) {
+	err = u.scanNamespace(ctx, func(batch []string) error {
+		keys = append(keys, batch...)
+		return nil
+	})
+
+	return keys, err
+}
+
+// DeleteNamespace delete all keys under key prefix,
+// return how many keys are deleted
+func (u *Utils) DeleteNamespace(ctx context.Context) (deleted int64, err error) {
+	err = u.scanNamespace(ctx, func(keys []string) error {
+		// delete one by one, keys may be in different slots
+		cmds, err := u.Pipelined(ctx, func(p redis.Pipeliner) error {
+			for _, key := range keys {
+				p.Del(ctx, key)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "delete keys")
+		}
+
+		for _, cmd := range cmds {
+			deleted += cmd.(*redis.IntCmd).Val()
+		}
+
+		return nil
+	})
+
+	return deleted, err
 }
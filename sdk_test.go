@@ -0,0 +1,200 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRedisUtils_universal(t *testing.T) {
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mu, err := rtils.NewMutex("TestNewRedisUtils_universal")
+	require.NoError(t, err)
+
+	locked, _, err := mu.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, mu.Unlock(ctx))
+}
+
+func TestUtils_keyNamespace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rdb := redis.NewClient(&redis.Options{})
+	prefix := "/TestUtils_keyNamespace/" + gutils.RandomStringWithLength(10) + "/"
+	rtils := NewRedisUtils(rdb, WithUtilsKeyPrefix(prefix))
+
+	mu, err := rtils.NewMutex("laisky")
+	require.NoError(t, err)
+	locked, _, err := mu.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	sema, err := rtils.NewSemaphore("laisky", 1)
+	require.NoError(t, err)
+	locked, _, err = sema.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	r, err := rtils.NewRank("laisky", 10)
+	require.NoError(t, err)
+	require.NoError(t, r.Set(ctx, "user", 1, 1))
+
+	keys, err := rtils.ListNamespaceKeys(ctx)
+	require.NoError(t, err)
+	require.Contains(t, keys, prefix+"sync/mutex/{laisky}")
+	require.Contains(t, keys, prefix+"rank/{laisky}/data/")
+	for _, key := range keys {
+		require.True(t, strings.HasPrefix(key, prefix))
+	}
+
+	deleted, err := rtils.DeleteNamespace(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(keys)), deleted)
+
+	keys, err = rtils.ListNamespaceKeys(ctx)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// key builder
+	rtils = NewRedisUtils(rdb, WithUtilsKeyBuilder(func(prefix, key string) string {
+		return "app:" + strings.ReplaceAll(key, "/", ":")
+	}))
+	require.Equal(t, "app:sync:mutex:{laisky}", rtils.buildKey(defaultKeySyncMutex, "laisky"))
+
+	// namespace is derived from key builder
+	app := "app" + gutils.RandomStringWithLength(10)
+	rtils = NewRedisUtils(rdb, WithUtilsKeyBuilder(func(prefix, key string) string {
+		return app + ":" + strings.ReplaceAll(key, "/", ":") + ":" + app
+	}))
+	require.NoError(t, rdb.Set(ctx, rtils.buildKey(defaultKeySyncMutex, "laisky"), 1, KeyExpImmortal).Err())
+	require.NoError(t, rdb.Set(ctx, app+":other", 1, KeyExpImmortal).Err())
+	keys, err = rtils.ListNamespaceKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{app + ":sync:mutex:{laisky}:" + app}, keys)
+	deleted, err = rtils.DeleteNamespace(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+	require.NoError(t, rdb.Del(ctx, app+":other").Err())
+
+	// key builder drops relative key
+	rtils = NewRedisUtils(rdb, WithUtilsKeyBuilder(func(prefix, key string) string {
+		return prefix
+	}))
+	_, err = rtils.ListNamespaceKeys(ctx)
+	require.ErrorIs(t, err, ErrInvalidArgument)
+
+	// invalid option
+	_, err = NewRedisUtilsE(rdb, WithUtilsKeyPrefix(""))
+	require.Error(t, err)
+	rtils = NewRedisUtils(rdb, WithUtilsKeyPrefix(""))
+	require.Equal(t, DefaultKeyPrefix, rtils.KeyPrefix())
+}
+
+func TestNewRedisUtils_options(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		metrics []*Metric
+	)
+	rtils, err := NewRedisUtilsE(redis.NewClient(&redis.Options{}),
+		WithUtilsLockTTL(time.Second),
+		WithUtilsCacheTTL(time.Minute),
+		WithUtilsStartupProbe(time.Second),
+		WithUtilsMetrics(MetricsHookFunc(func(ctx context.Context, m *Metric) {
+			mu.Lock()
+			defer mu.Unlock()
+			metrics = append(metrics, m)
+		})),
+	)
+	require.NoError(t, err)
+
+	lock, err := rtils.NewMutex("TestNewRedisUtils_options")
+	require.NoError(t, err)
+	require.Equal(t, time.Second, lock.(*mutex).ttl)
+
+	locked, _, err := lock.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, lock.Unlock(ctx))
+
+	mu.Lock()
+	require.Len(t, metrics, 2)
+	require.Equal(t, "mutex", metrics[0].Primitive)
+	require.Equal(t, "lock", metrics[0].Op)
+	require.True(t, metrics[0].OK)
+	mu.Unlock()
+
+	// startup probe failed
+	_, err = NewRedisUtilsE(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}),
+		WithUtilsStartupProbe(time.Second))
+	require.Error(t, err)
+}
+
+func TestSetLogger_existingUtils(t *testing.T) {
+	rtils := NewRedisUtils(redis.NewClient(&redis.Options{}))
+
+	old := getLogger()
+	defer SetLogger(old)
+
+	named := rtils.logger.Named("sub")
+	lg, err := gutils.NewConsoleLoggerWithName("TestSetLogger_existingUtils", gutils.LoggerLevelDebug)
+	require.NoError(t, err)
+	SetLogger(lg)
+
+	require.Equal(t, lg.Core(), rtils.logger.Core())
+	require.Equal(t, lg.Core(), named.Core())
+
+	// derived logger is cached until logger is replaced
+	gl := named.(*globalLogger)
+	cached := gl.get()
+	require.Same(t, cached, gl.get())
+	SetLogger(old)
+	require.NotSame(t, cached, gl.get())
+	require.Equal(t, old.Core(), named.Core())
+}
+
+func TestUtils_keyNamespace_ring(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rdb := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"a": "127.0.0.1:6379", "b": "127.0.0.1:6379"},
+		NewClient: func(name string, opt *redis.Options) *redis.Client {
+			// shards on different db
+			opt.DB = map[string]int{"a": 4, "b": 5}[name]
+			return redis.NewClient(opt)
+		},
+	})
+	prefix := "/TestUtils_keyNamespace_ring/" + gutils.RandomStringWithLength(10) + "/"
+	rtils := NewRedisUtils(rdb, WithUtilsKeyPrefix(prefix))
+
+	var expect []string
+	for i := 0; i < 20; i++ {
+		key := prefix + gutils.RandomStringWithLength(10)
+		require.NoError(t, rdb.Set(ctx, key, i, KeyExpImmortal).Err())
+		expect = append(expect, key)
+	}
+
+	keys, err := rtils.ListNamespaceKeys(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, expect, keys)
+
+	deleted, err := rtils.DeleteNamespace(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(expect)), deleted)
+}
@@ -2,8 +2,7 @@ package redis
 
 import (
 	"context"
-	"fmt"
-	"strconv"
+	"sync"
 	"time"
 
 	gutils "github.com/Laisky/go-utils"
@@ -12,11 +11,98 @@ import (
 	"github.com/pkg/errors"
 )
 
+// semaphoreLockScript acquire or reenter semaphore
+//
+// KEYS[1]: cids, client_id -> timestamp
+// KEYS[2]: owners, client_id -> counter
+// KEYS[3]: counter
+// ARGV[1]: client id
+// ARGV[2]: now in milliseconds
+// ARGV[3]: ttl in milliseconds
+// ARGV[4]: limit of semaphore
+//
+// return 1 if acquired, 0 if semaphore is full
+var semaphoreLockScript = redis.NewScript(`
+local now = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - tonumber(ARGV[3]))
+redis.call("ZINTERSTORE", KEYS[2], 2, KEYS[2], KEYS[1], "WEIGHTS", 1, 0, "AGGREGATE", "MAX")
+
+if redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	redis.call("ZADD", KEYS[1], now, ARGV[1])
+	return 1
+end
+
+local counter = redis.call("INCR", KEYS[3])
+redis.call("ZADD", KEYS[2], counter, ARGV[1])
+redis.call("ZADD", KEYS[1], now, ARGV[1])
+if redis.call("ZRANK", KEYS[2], ARGV[1]) < tonumber(ARGV[4]) then
+	return 1
+end
+
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[1], ARGV[1])
+return 0
+`)
+
+// semaphoreRefreshScript refresh client's timestamp if still owns the semaphore
+//
+// KEYS[1]: cids
+// KEYS[2]: owners
+// ARGV[1]: client id
+// ARGV[2]: now in milliseconds
+// ARGV[3]: ttl in milliseconds
+//
+// return 1 if refreshed, 0 if semaphore is not held by this client
+var semaphoreRefreshScript = redis.NewScript(`
+local ts = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not ts or tonumber(ts) < tonumber(ARGV[2]) - tonumber(ARGV[3]) then
+	return 0
+end
+if not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	return 0
+end
+
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+return 1
+`)
+
+// semaphoreTTLScript timestamp of client if still owns the semaphore
+//
+// KEYS[1]: cids
+// KEYS[2]: owners
+// ARGV[1]: client id
+//
+// return last refreshed timestamp in milliseconds, -1 if semaphore is not held by this client
+var semaphoreTTLScript = redis.NewScript(`
+local ts = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not ts or not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	return -1
+end
+return tonumber(ts)
+`)
+
+// semaphoreUnlockScript release semaphore, then notify waiters
+//
+// KEYS[1]: cids
+// KEYS[2]: owners
+// ARGV[1]: client id
+// ARGV[2]: release channel
+//
+// return 1 if released, 0 if semaphore is not held by this client
+var semaphoreUnlockScript = redis.NewScript(`
+redis.call("ZREM", KEYS[1], ARGV[1])
+if redis.call("ZREM", KEYS[2], ARGV[1]) == 1 then
+	redis.call("PUBLISH", ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
 // semaphore distributed fair semaphore
 //
 // Redis keys:
 //
-//	`/rtils/sync/sema/<lock_id>/`
+//	`/rtils/sync/sema/{<lock_id>}/`
 //
 //	* cids/: client_id -> ts, all clients
 //	* owners/: client_id -> counter, all clients acquired lock
@@ -27,31 +113,51 @@ import (
 //
 // Implementations:
 //
+// acquisition, refresh and release are lua scripts,
+// all steps below run atomically in one round trip.
+//
 //  1. generate client id(cid)
 //  2. delete all expired clients in `cids`,
 //     by `ZREMRANGEBYSCORE cids -inf <now - ttl>`
 //  3. delete all expired clients in `owners`,
 //     by `ZINTERSTORE owners 2 owners cids WEIGHTS 1 0`
-//  4. increment semaphore's counter
-//  5. add cid:counter to `owners`, get rank (smaller is better).
-//     5-1. delete from `owners` if the rank is over the limit of semaphore
-//  6. add cid:timestamp to `cids`
+//  4. if cid already in `owners`, refresh its timestamp in `cids` (reentrant)
+//  5. increment semaphore's counter
+//  6. add cid:counter to `owners`, add cid:timestamp to `cids`,
+//     get rank (smaller is better).
+//     6-1. delete from `owners` and `cids` if the rank is over the limit of semaphore
+//  7. unlock: delete cid from `owners` and `cids`, then publish to release channel
+//  8. blocking waiters subscribe release channel, retry once notified,
+//     or spin as fallback if notification is lost
 type Semaphore interface {
 	// Lock acquire a recursive lock
 	//
 	// if succeed acquired lock,
 	//   * locked == true
 	//   * lockCtx is context of lock, this context will be set to done when lock is expired
+	//
+	// return locked == false with ErrLockTaken if semaphore is full and not blocking.
 	Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error)
 	// Unlock release lock
+	//
+	// return ErrLockNotHeld if semaphore is not held by this client.
 	Unlock(ctx context.Context) (err error)
+	// Acquire acquire a new slot of semaphore, return its handle
+	//
+	// unlike Lock, each acquisition gets its own handle and occupies its own slot,
+	// so one Semaphore could be shared by multiple goroutines.
+	// return ErrLockTaken if semaphore is full and not blocking.
+	Acquire(ctx context.Context) (LockHandle, error)
 }
 
 type semaphore struct {
 	semaOption
 	rdb    *Utils
 	logger gutils.LoggerItf
-	cancel context.CancelFunc
+
+	// mu protects lease of Lock/Unlock
+	mu    sync.Mutex
+	lease *lockLease
 
 	// limit of semaphore
 	limit int
@@ -63,7 +169,9 @@ type semaphore struct {
 	//   client_id -> counter
 	owners,
 	// counter current count number of the lock
-	counter string
+	counter,
+	// channel pub/sub channel to notify lock released
+	channel string
 }
 
 type semaOption struct {
@@ -89,6 +197,24 @@ func WithSemaphoreSpinInterval(interval time.Duration) SemaphoreOptionFunc {
 	}
 }
 
+// WithSemaphoreReleaseNotify set whether to subscribe release notification
+// when waiting for lock, otherwise spin every spin interval
+func WithSemaphoreReleaseNotify(enable bool) SemaphoreOptionFunc {
+	return func(mu *semaphore) error {
+		mu.releaseNotify = enable
+		return nil
+	}
+}
+
+// WithSemaphoreNotifyFallbackInterval set retry interval when subscribed release notification,
+// in case of notification is lost or lock is expired without release
+func WithSemaphoreNotifyFallbackInterval(interval time.Duration) SemaphoreOptionFunc {
+	return func(mu *semaphore) error {
+		mu.notifyFallbackInterval = interval
+		return nil
+	}
+}
+
 // WithSemaphoreBlockingLock set whether blocking lock
 func WithSemaphoreBlockingLock(blocking bool) SemaphoreOptionFunc {
 	return func(mu *semaphore) error {
@@ -105,6 +231,42 @@ func WithSemaphoreTTL(ttl time.Duration) SemaphoreOptionFunc {
 	}
 }
 
+// WithSemaphoreRefreshRetryInterval set retry interval when failed to refresh semaphore,
+// semaphore keeps retrying until ttl deadline
+func WithSemaphoreRefreshRetryInterval(interval time.Duration) SemaphoreOptionFunc {
+	return func(mu *semaphore) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "retry interval must greater than 0")
+		}
+
+		mu.refreshRetryInterval = interval
+		return nil
+	}
+}
+
+// WithSemaphoreRefreshGrace consider semaphore as lost `grace` before ttl deadline
+// if failed to refresh semaphore, leave time for aborting jobs,
+// grace must less than ttl
+func WithSemaphoreRefreshGrace(grace time.Duration) SemaphoreOptionFunc {
+	return func(mu *semaphore) error {
+		if grace < 0 {
+			return errors.Wrap(ErrInvalidArgument, "grace must not less than 0")
+		}
+
+		mu.refreshGrace = grace
+		return nil
+	}
+}
+
+// WithSemaphoreOnLost set callback called once when semaphore is ended,
+// reason is one of ErrLockReleased, ErrLockExpired, ErrLockUnreachable or ctx.Err()
+func WithSemaphoreOnLost(onLost func(reason error)) SemaphoreOptionFunc {
+	return func(mu *semaphore) error {
+		mu.onLost = onLost
+		return nil
+	}
+}
+
 // WithSemaphoreLogger set lock's expiration
 func WithSemaphoreLogger(logger *gutils.LoggerType) SemaphoreOptionFunc {
 	return func(mu *semaphore) error {
@@ -127,10 +289,11 @@ func (u *Utils) NewSemaphore(lockName string, limit int, opts ...SemaphoreOption
 		limit:      limit,
 		rdb:        u,
 		logger:     u.logger,
-		cids:       fmt.Sprintf(defaultKeySyncSemaphoreLocks, lockName),
-		owners:     fmt.Sprintf(defaultKeySyncSemaphoreOwners, lockName),
-		counter:    fmt.Sprintf(defaultKeySyncSemaphoreCounter, lockName),
-		semaOption: semaOption{newMutexOption()},
+		cids:       u.buildKey(defaultKeySyncSemaphoreLocks, lockName),
+		owners:     u.buildKey(defaultKeySyncSemaphoreOwners, lockName),
+		counter:    u.buildKey(defaultKeySyncSemaphoreCounter, lockName),
+		channel:    u.buildKey(defaultKeySyncSemaphoreRelease, lockName),
+		semaOption: semaOption{u.newMutexOption()},
 	}
 
 	for _, optf := range opts {
@@ -139,133 +302,192 @@ func (u *Utils) NewSemaphore(lockName string, limit int, opts ...SemaphoreOption
 		}
 	}
 
+	if err := sema.validate(); err != nil {
+		return nil, err
+	}
+
 	return sema, nil
 }
 
-// Lock acquire a recursive lock
-//
-// if succeed acquired lock,
-//   - locked == true
-//   - lockCtx is context of lock, this context will be set to done when lock is expired
-func (s *semaphore) Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error) {
+// acquire try to acquire or reenter semaphore once
+func (s *semaphore) acquire(ctx context.Context, cid string) (ok bool, err error) {
+	if ok, err = semaphoreLockScript.Run(ctx, s.rdb,
+		[]string{s.cids, s.owners, s.counter},
+		cid,
+		s.rdb.clock.GetUTCNow().UnixMilli(),
+		s.ttl.Milliseconds(),
+		s.limit,
+	).Bool(); err != nil {
+		return false, errors.Wrapf(err, "acquire semaphore `%s`", s.cids)
+	}
+
+	return ok, nil
+}
+
+// extend refresh client's timestamp if still owns the semaphore
+func (s *semaphore) extend(ctx context.Context, cid string) (ok bool, err error) {
+	if ok, err = semaphoreRefreshScript.Run(ctx, s.rdb,
+		[]string{s.cids, s.owners},
+		cid,
+		s.rdb.clock.GetUTCNow().UnixMilli(),
+		s.ttl.Milliseconds(),
+	).Bool(); err != nil {
+		return false, errors.Wrapf(err, "refresh semaphore `%s`", s.cids)
+	}
+
+	return ok, nil
+}
+
+// release release semaphore, return false if semaphore is not held by this client
+func (s *semaphore) release(ctx context.Context, cid string) (ok bool, err error) {
+	if ok, err = semaphoreUnlockScript.Run(ctx, s.rdb,
+		[]string{s.cids, s.owners}, cid, s.channel).Bool(); err != nil {
+		return false, errors.Wrapf(err, "release semaphore `%s`", s.cids)
+	}
+
+	return ok, nil
+}
+
+// ttlOf remaining ttl of client if still owns the semaphore
+func (s *semaphore) ttlOf(ctx context.Context, cid string) (ttl time.Duration, ok bool, err error) {
+	ts, err := semaphoreTTLScript.Run(ctx, s.rdb, []string{s.cids, s.owners}, cid).Int64()
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "get ttl of semaphore `%s`", s.cids)
+	} else if ts < 0 {
+		return 0, false, nil
+	}
+
+	ttl = time.UnixMilli(ts).Add(s.ttl).Sub(s.rdb.clock.GetUTCNow())
+	if ttl <= 0 {
+		return 0, false, nil
+	}
+
+	return ttl, true, nil
+}
+
+// wait acquire semaphore by cid, block until acquired if blocking
+func (s *semaphore) wait(ctx context.Context, cid string) (ok bool, err error) {
+	waiter := newLockWaiter(s.rdb, s.logger, s.channel, s.mutexOption)
+	defer waiter.close()
+
 	for {
 		select {
 		case <-ctx.Done():
-			return locked, lockCtx, ctx.Err()
+			return false, ctx.Err()
 		default:
 		}
 
-		if _, err = s.rdb.Pipelined(ctx, func(pp redis.Pipeliner) (err error) {
-			expiredAt := strconv.Itoa(int(gutils.Clock.GetUTCNow().Add(-s.ttl).Unix()))
-			pp.ZRemRangeByScore(ctx, s.cids, "-inf", expiredAt)
-			pp.ZInterStore(ctx,
-				s.owners,
-				&redis.ZStore{
-					Keys:      []string{s.owners, s.cids},
-					Weights:   []float64{1, 0},
-					Aggregate: "MAX",
-				},
-			)
-			pp.Incr(ctx, s.counter)
-
-			var cnt int64
-			if rets, err := pp.Exec(ctx); err != nil {
-				return errors.WithStack(err)
-			} else if cnt, err = rets[len(rets)-1].(*redis.IntCmd).Result(); err != nil {
-				return errors.Wrapf(err, "get counter `%s`", rets[len(rets)-1].String())
-			}
-
-			pp.ZAdd(ctx, s.owners, &redis.Z{
-				Member: s.clientID,
-				Score:  float64(cnt),
-			})
-			pp.ZAdd(ctx, s.cids, &redis.Z{
-				Member: s.clientID,
-				Score:  float64(float64(gutils.Clock.GetUTCNow().Unix())),
-			})
-			pp.ZRank(ctx, s.owners, s.clientID)
-			s.logger.Debug("add new client", zap.Int64("score", cnt))
-
-			if rets, err := pp.Exec(ctx); err != nil {
-				return errors.WithStack(err)
-			} else if cnt, err = rets[len(rets)-1].(*redis.IntCmd).Result(); err != nil {
-				return errors.Wrapf(err, "get counter `%s`", rets[len(rets)-1].String())
-			}
-
-			if int(cnt)+1 > s.limit {
-				// failed to acquire lock
-				pp.ZRem(ctx, s.owners, s.clientID)
-				pp.ZRem(ctx, s.cids, s.clientID)
-			} else {
-				locked = true
-			}
-
-			return nil
-		}); err != nil {
-			return false, nil, errors.WithStack(err)
+		if ok, err = s.acquire(ctx, cid); err != nil {
+			return false, err
+		} else if ok || !s.blocking {
+			return ok, nil
 		}
 
-		if !locked {
-			if !s.blocking {
-				return false, nil, nil
-			}
+		waiter.wait(ctx)
+	}
+}
 
-			time.Sleep(s.spinInterval)
-			continue
-		}
+// Lock acquire a recursive lock
+//
+// if succeed acquired lock,
+//   - locked == true
+//   - lockCtx is context of lock, this context will be set to done when lock is expired
+func (s *semaphore) Lock(ctx context.Context) (locked bool, lockCtx context.Context, err error) {
+	defer func(start time.Time) {
+		s.rdb.observe(ctx, "semaphore", s.cids, "lock", start, locked, err)
+	}(time.Now())
+
+	if locked, err = s.wait(ctx, s.clientID); err != nil {
+		return false, nil, err
+	} else if !locked {
+		return false, nil, errors.Wrapf(ErrLockTaken, "semaphore `%s` is full", s.cids)
+	}
 
-		if s.cancel != nil {
-			s.cancel()
-		}
+	s.mu.Lock()
+	if s.lease != nil {
+		s.lease.stop()
+	}
 
-		lockCtx, s.cancel = context.WithCancel(ctx)
-		go s.refreshLock(lockCtx, s.cancel)
+	lease := newLockLease(ctx, s.onLost)
+	s.lease = lease
+	s.mu.Unlock()
 
-		return locked, lockCtx, nil
-	}
+	go s.refreshLock(lease, s.clientID)
+	return true, lease.ctx, nil
 }
 
 // Unlock release lock
 func (s *semaphore) Unlock(ctx context.Context) (err error) {
-	if _, err = s.rdb.TxPipelined(ctx, func(pp redis.Pipeliner) error {
-		pp.ZRem(ctx, s.owners, s.clientID)
-		pp.ZRem(ctx, s.cids, s.clientID)
-		return nil
-	}); err != nil {
-		return errors.WithStack(err)
+	defer func(start time.Time) {
+		s.rdb.observe(ctx, "semaphore", s.cids, "unlock", start, err == nil, err)
+	}(time.Now())
+
+	released, err := s.release(ctx, s.clientID)
+	if err != nil {
+		return err
 	}
 
-	s.cancel()
-	return
-}
+	reason := ErrLockReleased
+	if !released {
+		s.logger.Warn("semaphore not held by this client", zap.String("lock", s.cids))
+		reason = ErrLockNotHeld
+	}
 
-func (s *semaphore) refreshLock(ctx context.Context, cancel func()) {
-	defer cancel()
-	ticker := time.NewTicker(s.heartbeatInterval)
-	defer ticker.Stop()
+	s.mu.Lock()
+	if s.lease != nil {
+		s.lease.end(reason)
+		s.lease = nil
+	}
+	s.mu.Unlock()
 
-	logger := s.logger.With(zap.String("lock", s.cids))
-	defer logger.Debug("release key")
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-		}
+	if !released {
+		return ErrLockNotHeld
+	}
 
-		if err := s.rdb.ZAddXX(ctx, s.cids, &redis.Z{
-			Member: s.clientID,
-			Score:  float64(gutils.Clock.GetUTCNow().Unix()),
-		}).Err(); err != nil {
-			if IsNil(err) {
-				logger.Warn("lock not exists")
-				return
-			}
-
-			logger.Error("refresh semaphore", zap.Error(err))
-			return
-		}
+	return nil
+}
 
-		logger.Debug("succeed renew lock")
+// Acquire acquire a new slot of semaphore, return its handle
+func (s *semaphore) Acquire(ctx context.Context) (handle LockHandle, err error) {
+	defer func(start time.Time) {
+		s.rdb.observe(ctx, "semaphore", s.cids, "acquire", start, err == nil, err)
+	}(time.Now())
+
+	cid := newHandleClientID(s.clientID)
+	ok, err := s.wait(ctx, cid)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Wrapf(ErrLockTaken, "semaphore `%s` is full", s.cids)
 	}
+
+	lease := newLockLease(ctx, s.onLost)
+	go s.refreshLock(lease, cid)
+
+	return &lockHandle{
+		cid:   cid,
+		ctx:   lease.ctx,
+		lease: lease,
+		extend: func(ctx context.Context) (bool, error) {
+			return s.extend(ctx, cid)
+		},
+		release: func(ctx context.Context) (bool, error) {
+			return s.release(ctx, cid)
+		},
+		ttl: func(ctx context.Context) (time.Duration, bool, error) {
+			return s.ttlOf(ctx, cid)
+		},
+	}, nil
+}
+
+// refreshLock keep semaphore held by cid alive until lease is ended
+func (s *semaphore) refreshLock(lease *lockLease, cid string) {
+	keepAlive(lease, s.mutexOption, s.logger.With(zap.String("lock", s.cids)),
+		func(ctx context.Context) (bool, error) {
+			return s.extend(ctx, cid)
+		},
+		func(ctx context.Context) error {
+			return ErrLockExpired
+		},
+	)
 }
@@ -2,12 +2,16 @@ package redis
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	gutils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
 	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestSemaphore_Lock(t *testing.T) {
@@ -125,3 +129,167 @@ func BenchmarkSemaphore(b *testing.B) {
 		}
 	})
 }
+
+func TestSemaphore_limit(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	var (
+		holders int32
+		pool    errgroup.Group
+	)
+	for i := 0; i < 10; i++ {
+		sema, err := rtils.NewSemaphore(lockName, 2, WithSemaphoreSpinInterval(time.Millisecond))
+		require.NoError(t, err)
+
+		pool.Go(func() error {
+			for j := 0; j < 5; j++ {
+				if _, _, err := sema.Lock(ctx); err != nil {
+					return err
+				}
+
+				if got := atomic.AddInt32(&holders, 1); got > 2 {
+					return errors.Errorf("got %d holders", got)
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+
+				if err := sema.Unlock(ctx); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	require.NoError(t, pool.Wait())
+}
+
+func TestSemaphore_releaseNotify(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lockName := "laisky" + gutils.RandomStringWithLength(10)
+	sema1, err := rtils.NewSemaphore(lockName, 1)
+	require.NoError(t, err)
+	sema2, err := rtils.NewSemaphore(lockName, 1,
+		WithSemaphoreNotifyFallbackInterval(time.Minute),
+	)
+	require.NoError(t, err)
+
+	locked, _, err := sema1.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := sema1.Unlock(ctx); err != nil {
+			logger.Panic("unlock", zap.Error(err))
+		}
+	}()
+
+	start := time.Now()
+	locked, _, err = sema2.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.Less(t, time.Since(start), time.Second)
+	require.NoError(t, sema2.Unlock(ctx))
+}
+
+func TestSemaphore_Acquire(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sema, err := rtils.NewSemaphore("laisky"+gutils.RandomStringWithLength(10), 2,
+		WithSemaphoreBlockingLock(false))
+	require.NoError(t, err)
+
+	// each handle occupies its own slot
+	h1, err := sema.Acquire(ctx)
+	require.NoError(t, err)
+	h2, err := sema.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = sema.Acquire(ctx)
+	require.ErrorIs(t, err, ErrLockTaken)
+
+	ttl, err := h1.TTL(ctx)
+	require.NoError(t, err)
+	require.Greater(t, ttl, time.Duration(0))
+	require.NoError(t, h1.Extend(ctx))
+
+	require.NoError(t, h1.Unlock(ctx))
+	require.Error(t, h1.Ctx().Err())
+	require.ErrorIs(t, h1.Unlock(ctx), ErrLockReleased)
+	_, err = h1.TTL(ctx)
+	require.ErrorIs(t, err, ErrLockReleased)
+
+	h3, err := sema.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, h2.Unlock(ctx))
+	require.NoError(t, h3.Unlock(ctx))
+}
+
+func TestSemaphore_Unlock_notHeld(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sema, err := rtils.NewSemaphore("laisky"+gutils.RandomStringWithLength(10), 1)
+	require.NoError(t, err)
+
+	// should not panic without Lock
+	require.ErrorIs(t, sema.Unlock(ctx), ErrLockNotHeld)
+
+	locked, lockCtx, err := sema.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, sema.Unlock(ctx))
+	require.Error(t, lockCtx.Err())
+	require.ErrorIs(t, sema.Unlock(ctx), ErrLockNotHeld)
+}
+
+func TestSemaphore_OnLost(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lockid := "laisky" + gutils.RandomStringWithLength(10)
+	reasons := make(chan error, 1)
+	sema, err := rtils.NewSemaphore(lockid, 1,
+		WithSemaphoreTTL(500*time.Millisecond),
+		WithSemaphoreRefreshInterval(100*time.Millisecond),
+		WithSemaphoreOnLost(func(reason error) {
+			reasons <- reason
+		}),
+	)
+	require.NoError(t, err)
+
+	locked, lockCtx, err := sema.Lock(ctx)
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, sema.Unlock(ctx))
+	require.ErrorIs(t, <-reasons, ErrLockReleased)
+	require.Error(t, lockCtx.Err())
+
+	h, err := sema.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rdb.Del(ctx, rtils.buildKey(defaultKeySyncSemaphoreOwners, lockid)).Err())
+	require.ErrorIs(t, <-reasons, ErrLockExpired)
+	<-h.Ctx().Done()
+	require.ErrorIs(t, h.Unlock(ctx), ErrLockNotHeld)
+}
@@ -0,0 +1,523 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStreamConsumerConcurrency   = 10
+	defaultStreamConsumerBlock         = time.Second
+	defaultStreamConsumerClaimIdle     = 30 * time.Second
+	defaultStreamConsumerClaimInterval = 10 * time.Second
+	defaultStreamConsumerStartID       = "$"
+	defaultStreamAckTimeout            = 5 * time.Second
+)
+
+// StreamHandler handle message from stream,
+// message will be acked if return nil,
+// otherwise message will be redelivered after claim idle timeout
+type StreamHandler func(ctx context.Context, msg redis.XMessage) error
+
+// StreamConsumer consumer-group worker of redis streams
+//
+// Implementations:
+//
+//  1. create consumer group by `XGROUP CREATE ... MKSTREAM`, ignore `BUSYGROUP`
+//  2. read new messages by `XREADGROUP`, handle them in a bounded goroutine pool
+//  3. `XACK` message if handler succeeded
+//  4. every claim interval, claim messages idle longer than claim idle timeout
+//     from all consumers in the group by `XAUTOCLAIM`, then handle them again
+//  5. messages being handled are skipped by claiming, and their idle time
+//     is reset by `XCLAIM ... JUSTID` every half of claim idle timeout,
+//     so slow handlers will not be claimed by itself or other consumers
+//  6. stop reading once ctx is done, wait for running handlers to finish
+type StreamConsumer interface {
+	// Run consume messages, block until ctx done and all running handlers finished.
+	//
+	// handlers receive the same ctx.
+	Run(ctx context.Context) error
+}
+
+type streamConsumerOption struct {
+	consumer      string
+	concurrency   int
+	batchSize     int
+	block         time.Duration
+	claimIdle     time.Duration
+	claimInterval time.Duration
+	startID       string
+}
+
+type streamConsumer struct {
+	streamConsumerOption
+	rdb     *Utils
+	logger  gutils.LoggerItf
+	stream  string
+	group   string
+	handler StreamHandler
+
+	// inflightMu protects inflight
+	inflightMu sync.Mutex
+	// inflight ids of messages dispatched but not finished yet
+	inflight map[string]struct{}
+}
+
+// StreamConsumerOptionFunc options for stream consumer
+type StreamConsumerOptionFunc func(*streamConsumer) error
+
+// WithStreamConsumerName set consumer name in group,
+// should be unique and stable between restarts,
+// will auto generate by UUID4 if not set
+func WithStreamConsumerName(name string) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		if name == "" {
+			return errors.Wrap(ErrInvalidArgument, "consumer name must not be empty")
+		}
+
+		c.consumer = name
+		return nil
+	}
+}
+
+// WithStreamConsumerConcurrency set max running handlers
+func WithStreamConsumerConcurrency(concurrency int) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		if concurrency <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "concurrency must greater than 0")
+		}
+
+		c.concurrency = concurrency
+		return nil
+	}
+}
+
+// WithStreamConsumerBatchSize set how many messages read by each `XREADGROUP`,
+// default equals to concurrency
+func WithStreamConsumerBatchSize(size int) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		if size <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "batch size must greater than 0")
+		}
+
+		c.batchSize = size
+		return nil
+	}
+}
+
+// WithStreamConsumerBlock set block timeout of each `XREADGROUP`,
+// ctx is checked between each `XREADGROUP`
+func WithStreamConsumerBlock(block time.Duration) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		if block <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "block must greater than 0")
+		}
+
+		c.block = block
+		return nil
+	}
+}
+
+// WithStreamConsumerClaimIdle set how long a pending message could be idle
+// before being claimed by other consumers
+func WithStreamConsumerClaimIdle(idle time.Duration) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		if idle < time.Millisecond {
+			return errors.Wrap(ErrInvalidArgument, "claim idle must not less than 1ms")
+		}
+
+		c.claimIdle = idle
+		return nil
+	}
+}
+
+// WithStreamConsumerClaimInterval set interval of claiming idle messages
+func WithStreamConsumerClaimInterval(interval time.Duration) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		if interval <= 0 {
+			return errors.Wrap(ErrInvalidArgument, "claim interval must greater than 0")
+		}
+
+		c.claimInterval = interval
+		return nil
+	}
+}
+
+// WithStreamConsumerStartID set start id when creating group,
+// `$` means only new messages, `0` means all messages in stream
+func WithStreamConsumerStartID(id string) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		if id == "" {
+			return errors.Wrap(ErrInvalidArgument, "start id must not be empty")
+		}
+
+		c.startID = id
+		return nil
+	}
+}
+
+// WithStreamConsumerLogger set consumer's logger
+func WithStreamConsumerLogger(logger *gutils.LoggerType) StreamConsumerOptionFunc {
+	return func(c *streamConsumer) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// NewStreamConsumer new consumer-group worker of stream
+func (u *Utils) NewStreamConsumer(stream, group string, handler StreamHandler,
+	opts ...StreamConsumerOptionFunc) (StreamConsumer, error) {
+	if stream == "" || group == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, "stream and group must not be empty")
+	}
+	if handler == nil {
+		return nil, errors.Wrap(ErrInvalidArgument, "handler must not be nil")
+	}
+
+	c := &streamConsumer{
+		rdb:      u,
+		logger:   u.logger,
+		stream:   stream,
+		group:    group,
+		handler:  handler,
+		inflight: map[string]struct{}{},
+		streamConsumerOption: streamConsumerOption{
+			consumer:      uuid.New().String(),
+			concurrency:   defaultStreamConsumerConcurrency,
+			block:         defaultStreamConsumerBlock,
+			claimIdle:     defaultStreamConsumerClaimIdle,
+			claimInterval: defaultStreamConsumerClaimInterval,
+			startID:       defaultStreamConsumerStartID,
+		},
+	}
+	for _, optf := range opts {
+		if err := optf(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.batchSize == 0 {
+		c.batchSize = c.concurrency
+	}
+
+	c.logger = c.logger.With(
+		zap.String("stream", stream),
+		zap.String("group", group),
+		zap.String("consumer", c.consumer))
+	return c, nil
+}
+
+// ensureGroup create consumer group if not exists
+func (c *streamConsumer) ensureGroup(ctx context.Context) error {
+	if err := c.rdb.XGroupCreateMkStream(ctx, c.stream, c.group, c.startID).Err(); err != nil {
+		if strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil
+		}
+
+		return errors.Wrapf(err, "create group `%s` on stream `%s`", c.group, c.stream)
+	}
+
+	return nil
+}
+
+// Run consume messages, block until ctx done and all running handlers finished
+func (c *streamConsumer) Run(ctx context.Context) (err error) {
+	if err = c.ensureGroup(ctx); err != nil {
+		return err
+	}
+
+	var (
+		wg          sync.WaitGroup
+		pool        = make(chan struct{}, c.concurrency)
+		stopRefresh = make(chan struct{})
+		refreshDone = make(chan struct{})
+	)
+	go func() {
+		defer close(refreshDone)
+		c.refreshInflight(stopRefresh)
+	}()
+	// keep refreshing until all running handlers finished
+	defer func() {
+		wg.Wait()
+		close(stopRefresh)
+		<-refreshDone
+	}()
+
+	dispatch := func(msgs []redis.XMessage) {
+		msgs = c.track(msgs)
+		for i, msg := range msgs {
+			select {
+			case <-ctx.Done():
+				c.untrack(msgs[i:]...)
+				return
+			case pool <- struct{}{}:
+			}
+
+			wg.Add(1)
+			go func(msg redis.XMessage) {
+				defer wg.Done()
+				defer func() { <-pool }()
+				defer c.untrack(msg)
+				c.handle(ctx, msg)
+			}(msg)
+		}
+	}
+
+	lastClaim := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		if time.Since(lastClaim) >= c.claimInterval {
+			lastClaim = time.Now()
+			msgs, err := c.claim(ctx)
+			if err != nil {
+				c.logger.Warn("claim idle messages", zap.Error(err))
+			}
+
+			dispatch(msgs)
+		}
+
+		streams, err := c.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.consumer,
+			Streams:  []string{c.stream, ">"},
+			Count:    int64(c.batchSize),
+			Block:    c.block,
+		}).Result()
+		if err != nil {
+			if IsNil(err) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return errors.Wrapf(err, "xreadgroup `%s`", c.stream)
+		}
+
+		for _, stream := range streams {
+			dispatch(stream.Messages)
+		}
+	}
+}
+
+// handle run handler, then ack message if succeeded
+func (c *streamConsumer) handle(ctx context.Context, msg redis.XMessage) {
+	if err := c.handler(ctx, msg); err != nil {
+		c.logger.Warn("handle message, will be redelivered after idle timeout",
+			zap.String("id", msg.ID), zap.Error(err))
+		return
+	}
+
+	// ack even if ctx is done, handler already succeeded
+	ackCtx, cancel := context.WithTimeout(context.Background(), defaultStreamAckTimeout)
+	defer cancel()
+	if err := c.rdb.XAck(ackCtx, c.stream, c.group, msg.ID).Err(); err != nil {
+		c.logger.Error("ack message", zap.String("id", msg.ID), zap.Error(err))
+	}
+}
+
+// track mark messages as in-flight,
+// return messages those are not in-flight before
+func (c *streamConsumer) track(msgs []redis.XMessage) (tracked []redis.XMessage) {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+
+	for _, msg := range msgs {
+		if _, ok := c.inflight[msg.ID]; ok {
+			continue
+		}
+
+		c.inflight[msg.ID] = struct{}{}
+		tracked = append(tracked, msg)
+	}
+
+	return tracked
+}
+
+// untrack unmark in-flight messages
+func (c *streamConsumer) untrack(msgs ...redis.XMessage) {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+
+	for _, msg := range msgs {
+		delete(c.inflight, msg.ID)
+	}
+}
+
+// refreshInflight reset idle time of in-flight messages by `XCLAIM ... JUSTID`
+// every half of claimIdle, until stop is closed
+func (c *streamConsumer) refreshInflight(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.claimIdle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.inflightMu.Lock()
+		ids := make([]string, 0, len(c.inflight))
+		for id := range c.inflight {
+			ids = append(ids, id)
+		}
+		c.inflightMu.Unlock()
+		if len(ids) == 0 {
+			continue
+		}
+
+		// acked ids are not in pending list, will be ignored by `XCLAIM`
+		ctx, cancel := context.WithTimeout(context.Background(), defaultStreamAckTimeout)
+		err := c.rdb.XClaimJustID(ctx, &redis.XClaimArgs{
+			Stream:   c.stream,
+			Group:    c.group,
+			Consumer: c.consumer,
+			Messages: ids,
+		}).Err()
+		cancel()
+		if err != nil {
+			c.logger.Warn("refresh idle time of in-flight messages", zap.Error(err))
+		}
+	}
+}
+
+// claim claim all messages idle longer than claimIdle by `XAUTOCLAIM`
+//
+// use raw command, since the reply of redis 7 contains deleted ids
+func (c *streamConsumer) claim(ctx context.Context) (msgs []redis.XMessage, err error) {
+	start := "0-0"
+	for {
+		ret, err := c.rdb.Do(ctx, "XAUTOCLAIM", c.stream, c.group, c.consumer,
+			c.claimIdle.Milliseconds(), start, "COUNT", c.batchSize).Slice()
+		if err != nil {
+			return msgs, errors.Wrapf(err, "xautoclaim `%s`", c.stream)
+		}
+
+		var claimed []redis.XMessage
+		if start, claimed, err = parseXAutoClaim(ret); err != nil {
+			return msgs, err
+		}
+
+		msgs = append(msgs, claimed...)
+		if start == "0-0" || len(msgs) >= c.batchSize {
+			return msgs, nil
+		}
+	}
+}
+
+// parseXAutoClaim parse reply of `XAUTOCLAIM`:
+//
+//	[next_start, [[id, [field, value, ...]], ...], (deleted_ids)]
+func parseXAutoClaim(ret []interface{}) (next string, msgs []redis.XMessage, err error) {
+	if len(ret) < 2 {
+		return "", nil, errors.Errorf("unknown xautoclaim reply `%v`", ret)
+	}
+
+	next, _ = ret[0].(string)
+	entries, _ := ret[1].([]interface{})
+	for _, entry := range entries {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) != 2 {
+			continue // deleted message in redis 6.2
+		}
+
+		msg := redis.XMessage{Values: map[string]interface{}{}}
+		msg.ID, _ = fields[0].(string)
+		kvs, _ := fields[1].([]interface{})
+		for i := 0; i+1 < len(kvs); i += 2 {
+			k, _ := kvs[i].(string)
+			msg.Values[k] = kvs[i+1]
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return next, msgs, nil
+}
+
+// StreamProducer publish messages to stream
+type StreamProducer interface {
+	// Publish add message to stream, return message id
+	Publish(ctx context.Context, values map[string]interface{}) (id string, err error)
+}
+
+type streamProducer struct {
+	rdb    *Utils
+	stream string
+	maxLen int64
+	approx bool
+}
+
+// StreamProducerOptionFunc options for stream producer
+type StreamProducerOptionFunc func(*streamProducer) error
+
+// WithStreamProducerMaxLen trim stream to max length when publishing,
+// 0 means no limit
+func WithStreamProducerMaxLen(maxLen int64) StreamProducerOptionFunc {
+	return func(p *streamProducer) error {
+		if maxLen < 0 {
+			return errors.Wrap(ErrInvalidArgument, "max length must not less than 0")
+		}
+
+		p.maxLen = maxLen
+		return nil
+	}
+}
+
+// WithStreamProducerApproxTrim set whether trim stream by `MAXLEN ~`,
+// approximate trimming is much more efficient, enabled by default
+func WithStreamProducerApproxTrim(approx bool) StreamProducerOptionFunc {
+	return func(p *streamProducer) error {
+		p.approx = approx
+		return nil
+	}
+}
+
+// NewStreamProducer new producer of stream
+func (u *Utils) NewStreamProducer(stream string, opts ...StreamProducerOptionFunc) (StreamProducer, error) {
+	if stream == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, "stream must not be empty")
+	}
+
+	p := &streamProducer{
+		rdb:    u,
+		stream: stream,
+		approx: true,
+	}
+	for _, optf := range opts {
+		if err := optf(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Publish add message to stream, return message id
+func (p *streamProducer) Publish(ctx context.Context, values map[string]interface{}) (id string, err error) {
+	args := &redis.XAddArgs{
+		Stream: p.stream,
+		MaxLen: p.maxLen,
+		Approx: p.approx,
+		Values: values,
+	}
+	if id, err = p.rdb.XAdd(ctx, args).Result(); err != nil {
+		return "", errors.Wrapf(err, "xadd `%s`", p.stream)
+	}
+
+	return id, nil
+}
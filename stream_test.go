@@ -0,0 +1,191 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtils_NewStreamConsumer(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "laisky" + gutils.RandomStringWithLength(10)
+	producer, err := rtils.NewStreamProducer(stream, WithStreamProducerMaxLen(100))
+	require.NoError(t, err)
+
+	var (
+		mu       sync.Mutex
+		received = map[string]int{}
+		done     = make(chan struct{})
+	)
+	handler := func(ctx context.Context, msg redis.XMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		v := msg.Values["v"].(string)
+		received[v]++
+		if v == "fail" && received[v] == 1 {
+			return errors.New("fail at first time")
+		}
+
+		if len(received) == 3 && received["fail"] == 2 {
+			close(done)
+		}
+
+		return nil
+	}
+
+	consumer, err := rtils.NewStreamConsumer(stream, "group", handler,
+		WithStreamConsumerStartID("0"),
+		WithStreamConsumerBlock(100*time.Millisecond),
+		WithStreamConsumerClaimIdle(100*time.Millisecond),
+		WithStreamConsumerClaimInterval(200*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	for _, v := range []string{"a", "b", "fail"} {
+		_, err = producer.Publish(ctx, map[string]interface{}{"v": v})
+		require.NoError(t, err)
+	}
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() { errCh <- consumer.Run(runCtx) }()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("failed message not redelivered")
+	}
+
+	runCancel()
+	require.NoError(t, <-errCh)
+
+	pending, err := rdb.XPending(ctx, stream, "group").Result()
+	require.NoError(t, err)
+	require.Zero(t, pending.Count)
+
+	// create group again should not fail
+	require.NoError(t, consumer.(*streamConsumer).ensureGroup(ctx))
+}
+
+func TestUtils_NewStreamProducer(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+	ctx := context.Background()
+
+	stream := "laisky" + gutils.RandomStringWithLength(10)
+	producer, err := rtils.NewStreamProducer(stream,
+		WithStreamProducerMaxLen(5),
+		WithStreamProducerApproxTrim(false),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = producer.Publish(ctx, map[string]interface{}{"i": i})
+		require.NoError(t, err)
+	}
+
+	n, err := rdb.XLen(ctx, stream).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+
+	_, err = rtils.NewStreamProducer(stream, WithStreamProducerMaxLen(-1))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamProducer("")
+	require.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestUtils_NewStreamConsumer_slowHandler(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{})
+	rtils := NewRedisUtils(rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "laisky" + gutils.RandomStringWithLength(10)
+	producer, err := rtils.NewStreamProducer(stream)
+	require.NoError(t, err)
+
+	var (
+		mu      sync.Mutex
+		handled int
+		done    = make(chan struct{})
+	)
+	// handler runs much longer than claim idle
+	handler := func(ctx context.Context, msg redis.XMessage) error {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+
+		time.Sleep(time.Second)
+		close(done)
+		return nil
+	}
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		consumer, err := rtils.NewStreamConsumer(stream, "group", handler,
+			WithStreamConsumerStartID("0"),
+			WithStreamConsumerBlock(50*time.Millisecond),
+			WithStreamConsumerClaimIdle(300*time.Millisecond),
+			WithStreamConsumerClaimInterval(50*time.Millisecond),
+		)
+		require.NoError(t, err)
+		go func() { errCh <- consumer.Run(runCtx) }()
+	}
+
+	_, err = producer.Publish(ctx, map[string]interface{}{"v": "slow"})
+	require.NoError(t, err)
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("message not handled")
+	}
+
+	// wait for more claim rounds
+	time.Sleep(500 * time.Millisecond)
+	runCancel()
+	require.NoError(t, <-errCh)
+	require.NoError(t, <-errCh)
+
+	mu.Lock()
+	require.Equal(t, 1, handled)
+	mu.Unlock()
+
+	pending, err := rdb.XPending(ctx, stream, "group").Result()
+	require.NoError(t, err)
+	require.Zero(t, pending.Count)
+
+	// invalid options
+	_, err = rtils.NewStreamConsumer(stream, "group", handler, WithStreamConsumerBlock(0))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer(stream, "group", handler, WithStreamConsumerClaimIdle(0))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer(stream, "group", handler, WithStreamConsumerStartID(""))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer(stream, "group", handler, WithStreamConsumerName(""))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer(stream, "group", handler, WithStreamConsumerConcurrency(0))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer(stream, "group", handler, WithStreamConsumerBatchSize(0))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer(stream, "group", handler, WithStreamConsumerClaimInterval(0))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer("", "group", handler)
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = rtils.NewStreamConsumer(stream, "group", nil)
+	require.ErrorIs(t, err, ErrInvalidArgument)
+}